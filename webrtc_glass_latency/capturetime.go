@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+Capture-time propagation: frame_timestamp messages used to ride a
+DataChannel, then a WebSocket broadcast to every receiver, purely in
+parallel with the RTP it described - which raced the video it was timing,
+making glass-to-glass measurement noisy. absCaptureTimeURI is the header
+extension real WebRTC stacks already use for exactly this: the capture
+time travels inside the RTP packet itself, so a receiver reading it is
+reading the timestamp for the frame it just decoded, not a JSON message
+that happened to arrive nearby.
+*/
+
+// absCaptureTimeURI identifies the abs-capture-time RTP header extension,
+// carrying an NTP-format capture timestamp alongside each packet.
+const absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+// newCaptureTimeMediaEngine returns a MediaEngine with the default codecs
+// plus absCaptureTimeURI registered for video, so NewServer's api offers it
+// during SDP negotiation; wireSenderTrack resolves the ID it was actually
+// negotiated with via headerExtensionID once a publisher connects.
+func newCaptureTimeMediaEngine() (*webrtc.MediaEngine, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: absCaptureTimeURI},
+		webrtc.RTPCodecTypeVideo,
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// headerExtensionID looks up the numeric ID a receiver's SDP negotiation
+// assigned a header extension URI, or 0 if it wasn't negotiated.
+func headerExtensionID(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch
+// (1900-01-01) and the Unix epoch, needed to turn a Unix-based capture_ms
+// into the NTP format abs-capture-time wants.
+const ntpEpochOffset = 2208988800
+
+// encodeAbsCaptureTime encodes captureMs (Unix milliseconds) as the 8-byte
+// abs-capture-time payload: a 64-bit NTP timestamp with whole seconds
+// since 1900 in the high 32 bits and a fractional second in the low 32.
+func encodeAbsCaptureTime(captureMs float64) []byte {
+	seconds := captureMs/1000 + ntpEpochOffset
+	whole := uint32(seconds)
+	frac := uint32((seconds - float64(whole)) * (1 << 32))
+
+	return []byte{
+		byte(whole >> 24), byte(whole >> 16), byte(whole >> 8), byte(whole),
+		byte(frac >> 24), byte(frac >> 16), byte(frac >> 8), byte(frac),
+	}
+}
+
+// captureTimesSize bounds captureTimeCache the same way packetCacheSize
+// bounds PacketCache - a publisher that stops sending frame_timestamp
+// messages, or sends them out of order, can't grow it without bound.
+const captureTimesSize = 256
+
+type captureTimeEntry struct {
+	timestamp uint32
+	valid     bool
+	captureMs float64
+}
+
+// captureTimeCache is a fixed-size ring buffer mapping an RTP timestamp to
+// the capture_ms the sender reported for it over /ws, so wireSenderTrack's
+// forwarding goroutine can stamp each outgoing packet with the
+// abs-capture-time extension instead of broadcasting the timestamp out of
+// band. Mirrors PacketCache's ring-buffer shape in packetcache.go.
+type captureTimeCache struct {
+	mu      sync.Mutex
+	entries [captureTimesSize]captureTimeEntry
+}
+
+func newCaptureTimeCache() *captureTimeCache {
+	return &captureTimeCache{}
+}
+
+// record stores captureMs under rtpTimestamp, evicting whatever entry
+// previously occupied that slot.
+func (c *captureTimeCache) record(rtpTimestamp uint32, captureMs float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &c.entries[rtpTimestamp%captureTimesSize]
+	entry.timestamp = rtpTimestamp
+	entry.valid = true
+	entry.captureMs = captureMs
+}
+
+// lookup returns the capture_ms recorded for rtpTimestamp, if it's still
+// cached (not evicted, and actually the timestamp asked for).
+func (c *captureTimeCache) lookup(rtpTimestamp uint32) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &c.entries[rtpTimestamp%captureTimesSize]
+	if !entry.valid || entry.timestamp != rtpTimestamp {
+		return 0, false
+	}
+	return entry.captureMs, true
+}
@@ -0,0 +1,183 @@
+package main
+
+/*
+ICE configuration: hard-coding stun:stun.l.google.com:19302 everywhere
+works for a demo but not for viewers behind a symmetric NAT. iceConfigPath
+("ice.json") lets an operator supply their own STUN/TURN servers -
+including a TURN REST secret that turnRESTCredentials turns into
+short-lived per-connection credentials, draft-uberti-rtcweb-turn-rest
+style - and reload it with SIGHUP instead of a restart, the same
+operational shape galene's ice-servers.json reload supports.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// iceConfigPath is the file iceConfigStore reads at startup and on every
+// SIGHUP.
+const iceConfigPath = "ice.json"
+
+// turnRESTDefaultTTL is how long generated TURN REST credentials stay
+// valid when an ICEServerConfig doesn't specify its own TTL.
+const turnRESTDefaultTTL = time.Hour
+
+// ICEServerConfig is one ice.json server entry. Secret, if set, makes this
+// a TURN REST template: Username/Credential are ignored and a fresh pair
+// is generated per PeerConnection by turnRESTCredentials instead.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+
+	Secret string        `json:"secret,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+}
+
+// ICEConfig is the parsed shape of ice.json: which STUN/TURN servers to
+// offer, plus the SettingEngine options streaming plugins like
+// plugin-webrtc-plus expose as portmin/portmax/publicip/iceudpmux.
+type ICEConfig struct {
+	ICEServers []ICEServerConfig `json:"iceServers"`
+
+	// ICELite tells pion this relay always sits behind a public or
+	// port-forwarded address, so it can skip full ICE and just offer its
+	// host candidate.
+	ICELite bool `json:"iceLite"`
+
+	// NAT1To1IPs is advertised as ICECandidateTypeHost alongside
+	// discovered host candidates - set this for a 1:1 NAT/port-forward
+	// deployment rather than one that actually needs a TURN relay.
+	NAT1To1IPs []string `json:"nat1To1IPs"`
+
+	EphemeralUDPPortMin uint16 `json:"ephemeralUDPPortMin"`
+	EphemeralUDPPortMax uint16 `json:"ephemeralUDPPortMax"`
+}
+
+// defaultICEConfig matches the hard-coded Google STUN servers this relay
+// shipped with before ice.json existed.
+func defaultICEConfig() ICEConfig {
+	return ICEConfig{
+		ICEServers: []ICEServerConfig{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}
+}
+
+// loadICEConfig reads and parses iceConfigPath, falling back to
+// defaultICEConfig if it's missing or invalid.
+func loadICEConfig() ICEConfig {
+	data, err := os.ReadFile(iceConfigPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ICE config: failed to read %q, using defaults: %v", iceConfigPath, err)
+		}
+		return defaultICEConfig()
+	}
+
+	var cfg ICEConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("ICE config: failed to parse %q, using defaults: %v", iceConfigPath, err)
+		return defaultICEConfig()
+	}
+	return cfg
+}
+
+// turnRESTCredentials generates short-lived TURN REST-API credentials per
+// draft-uberti-rtcweb-turn-rest: username is "expiry:relay" and credential
+// is base64(HMAC-SHA1(secret, username)).
+func turnRESTCredentials(secret string, ttl time.Duration) (username, credential string) {
+	if ttl <= 0 {
+		ttl = turnRESTDefaultTTL
+	}
+	username = fmt.Sprintf("%d:relay", time.Now().Add(ttl).Unix())
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return username, credential
+}
+
+// webrtcICEServers resolves cfg's servers to what webrtc.Configuration
+// wants, minting fresh TURN REST credentials for any entry that sets
+// Secret.
+func (cfg ICEConfig) webrtcICEServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+	for _, s := range cfg.ICEServers {
+		server := webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential}
+		if s.Secret != "" {
+			server.Username, server.Credential = turnRESTCredentials(s.Secret, s.TTL)
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// settingEngine builds the pion SettingEngine cfg describes, so NewServer
+// can build its shared api around it once at startup.
+func (cfg ICEConfig) settingEngine() webrtc.SettingEngine {
+	var se webrtc.SettingEngine
+
+	se.SetLite(cfg.ICELite)
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	if cfg.EphemeralUDPPortMin > 0 && cfg.EphemeralUDPPortMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(cfg.EphemeralUDPPortMin, cfg.EphemeralUDPPortMax); err != nil {
+			log.Printf("ICE config: invalid ephemeral port range %d-%d: %v",
+				cfg.EphemeralUDPPortMin, cfg.EphemeralUDPPortMax, err)
+		}
+	}
+
+	return se
+}
+
+// iceConfigStore holds the live ICEConfig, swapped atomically on SIGHUP so
+// a reload never races with an in-flight PeerConnection negotiation
+// reading it.
+type iceConfigStore struct {
+	v atomic.Value // ICEConfig
+}
+
+// newICEConfigStore loads iceConfigPath once and returns a store ready for
+// get(); call watchSIGHUP separately to start reloading.
+func newICEConfigStore() *iceConfigStore {
+	s := &iceConfigStore{}
+	s.v.Store(loadICEConfig())
+	return s
+}
+
+func (s *iceConfigStore) get() ICEConfig {
+	return s.v.Load().(ICEConfig)
+}
+
+// watchSIGHUP reloads iceConfigPath every time this process receives
+// SIGHUP, letting an operator rotate TURN credentials or add a server
+// without restarting the relay.
+func (s *iceConfigStore) watchSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			cfg := loadICEConfig()
+			s.v.Store(cfg)
+			log.Printf("ICE config: reloaded %q (%d server(s))", iceConfigPath, len(cfg.ICEServers))
+		}
+	}()
+}
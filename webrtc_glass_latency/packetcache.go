@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// packetCacheSize is how many recent RTP packets PacketCache retains,
+// matching galene's packetcache default - enough to cover a NACK round
+// trip at typical video bitrates without unbounded memory growth.
+const packetCacheSize = 512
+
+type cacheEntry struct {
+	seqno uint16
+	valid bool
+	data  []byte
+}
+
+// PacketCache is a fixed-size ring buffer of recently forwarded RTP
+// packets, keyed by sequence number, so a Generic NACK (RFC 4585 FMT=1)
+// can be served by retransmission instead of waiting out the next PLI.
+type PacketCache struct {
+	mu      sync.Mutex
+	entries [packetCacheSize]cacheEntry
+}
+
+// NewPacketCache returns an empty PacketCache.
+func NewPacketCache() *PacketCache {
+	return &PacketCache{}
+}
+
+// Store records pkt's raw bytes under seqno, evicting whatever packet
+// previously occupied that slot.
+func (c *PacketCache) Store(seqno uint16, pkt []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &c.entries[seqno%packetCacheSize]
+	entry.seqno = seqno
+	entry.valid = true
+	entry.data = append(entry.data[:0], pkt...)
+}
+
+// Get copies the cached packet for seqno into buf and returns its length,
+// or 0 if seqno isn't cached (evicted, never stored, or buf is too small).
+func (c *PacketCache) Get(seqno uint16, buf []byte) (n uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &c.entries[seqno%packetCacheSize]
+	if !entry.valid || entry.seqno != seqno || len(entry.data) > len(buf) {
+		return 0
+	}
+	return uint16(copy(buf, entry.data))
+}
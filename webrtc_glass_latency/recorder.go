@@ -0,0 +1,206 @@
+package main
+
+/*
+Recording: a Stream can be told to persist its forwarded H264 to disk as a
+sequence of Annex B segment files, mirroring mediamtx's disk recorder and
+galene's "ask the sender for a keyframe rather than dropping" behavior.
+/record/{stream}/start|stop|list drive it; segments roll over to a fresh
+file at the first keyframe once recordingSegmentLength has elapsed, and a
+JSON manifest alongside them records which file covers which time range.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+)
+
+// recordingDir is where every stream's recordings land, one subdirectory
+// per stream ID.
+const recordingDir = "./recordings"
+
+// recordingSegmentLength is how long a segment runs before Recorder
+// rotates to a new file at the next keyframe.
+const recordingSegmentLength = 30 * time.Second
+
+// RecordingSegment is one segment file in a stream's manifest.
+type RecordingSegment struct {
+	File      string    `json:"file"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Recorder writes one Stream's forwarded H264 to disk as Annex B segment
+// files, rotating at keyframe boundaries so each segment is independently
+// decodable without needing to demux a container format.
+type Recorder struct {
+	streamID string
+	dir      string
+
+	mu           sync.Mutex
+	writer       *h264writer.H264Writer
+	segmentStart time.Time
+	pliRequested bool
+	segments     []RecordingSegment
+}
+
+// NewRecorder prepares streamID's recording directory and returns a
+// Recorder ready to accept WriteRTP calls.
+func NewRecorder(streamID string) (*Recorder, error) {
+	dir := filepath.Join(recordingDir, streamID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{streamID: streamID, dir: dir}, nil
+}
+
+// WriteRTP records one forwarded RTP packet, rotating to a new segment on
+// the first keyframe once recordingSegmentLength has elapsed. If packets
+// keep arriving without a keyframe, requestPLI is called exactly once per
+// segment rather than silently dropping packets forever - the caller
+// passes a closure that sends a PLI to the stream's publisher.
+func (rec *Recorder) WriteRTP(pkt *rtp.Packet, keyframe bool, requestPLI func()) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	due := rec.writer != nil && time.Since(rec.segmentStart) >= recordingSegmentLength
+	needsRotation := rec.writer == nil || (keyframe && due)
+	if needsRotation {
+		if !keyframe {
+			if !rec.pliRequested {
+				requestPLI()
+				rec.pliRequested = true
+			}
+			return
+		}
+		if err := rec.rotateLocked(); err != nil {
+			log.Printf("Recorder %s: failed to open segment: %v", rec.streamID, err)
+			return
+		}
+	} else if due && !rec.pliRequested {
+		// Rotation is due but this packet isn't a keyframe: ask for one
+		// once, and keep writing into the current segment meanwhile.
+		requestPLI()
+		rec.pliRequested = true
+	}
+
+	if err := rec.writer.WriteRTP(pkt); err != nil {
+		log.Printf("Recorder %s: failed to write segment: %v", rec.streamID, err)
+	}
+}
+
+// rotateLocked closes the current segment (if any) and opens a new one.
+// Callers must hold rec.mu.
+func (rec *Recorder) rotateLocked() error {
+	if rec.writer != nil {
+		rec.writer.Close()
+	}
+
+	name := fmt.Sprintf("%s-%d.h264", rec.streamID, time.Now().UnixNano())
+	writer, err := h264writer.New(filepath.Join(rec.dir, name))
+	if err != nil {
+		return err
+	}
+
+	rec.writer = writer
+	rec.segmentStart = time.Now()
+	rec.pliRequested = false
+	rec.segments = append(rec.segments, RecordingSegment{File: name, StartedAt: rec.segmentStart})
+
+	return rec.writeManifestLocked()
+}
+
+// writeManifestLocked (re)writes the JSON manifest listing every segment
+// recorded so far. Callers must hold rec.mu.
+func (rec *Recorder) writeManifestLocked() error {
+	data, err := json.MarshalIndent(rec.segments, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(rec.dir, "manifest.json"), data, 0o644)
+}
+
+// Segments returns a copy of the manifest recorded so far.
+func (rec *Recorder) Segments() []RecordingSegment {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	out := make([]RecordingSegment, len(rec.segments))
+	copy(out, rec.segments)
+	return out
+}
+
+// Close flushes and closes the currently open segment, if any.
+func (rec *Recorder) Close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.writer != nil {
+		rec.writer.Close()
+		rec.writer = nil
+	}
+}
+
+// =============================================================================
+// HTTP Handlers
+// =============================================================================
+
+// handleRecord implements /record/{stream}/start|stop|list: start/stop
+// enable or disable st's Recorder, list returns its manifest.
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	streamID, action := splitResourcePath(r.URL.Path, "/record/")
+	if streamID == "" || action == "" {
+		http.Error(w, "Usage: /record/{stream}/start|stop|list", http.StatusBadRequest)
+		return
+	}
+	st := s.stream(streamID)
+
+	switch action {
+	case "start":
+		st.recorderMu.Lock()
+		if st.recorder == nil {
+			rec, err := NewRecorder(streamID)
+			if err != nil {
+				st.recorderMu.Unlock()
+				http.Error(w, "Failed to start recording", http.StatusInternalServerError)
+				return
+			}
+			st.recorder = rec
+		}
+		st.recorderMu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "recording"})
+
+	case "stop":
+		st.recorderMu.Lock()
+		rec := st.recorder
+		st.recorder = nil
+		st.recorderMu.Unlock()
+		if rec != nil {
+			rec.Close()
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopped"})
+
+	case "list":
+		st.recorderMu.Lock()
+		rec := st.recorder
+		st.recorderMu.Unlock()
+		if rec == nil {
+			json.NewEncoder(w).Encode([]RecordingSegment{})
+			return
+		}
+		json.NewEncoder(w).Encode(rec.Segments())
+
+	default:
+		http.Error(w, "Unknown action, expected start|stop|list", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Layer is one simulcast/SVC encoding a publisher sends, identified by its
+// RTP stream ID (RID) - or "" for a publisher that isn't sending multiple
+// encodings at all. track is the shared local track every receiver tuned
+// to this layer is ultimately forwarded from; targetBitrate is this
+// layer's approximate encoder target, used to pick a layer against a
+// receiver's bandwidth estimate.
+type Layer struct {
+	rid           string
+	track         *webrtc.TrackLocalStaticRTP
+	targetBitrate int // bits/sec
+}
+
+// targetBitrateForRID approximates the encoder target for the simulcast
+// RID conventions browsers commonly send ("q"uarter/"h"alf/"f"ull
+// resolution), falling back to a single nominal bitrate for a publisher
+// that isn't simulcasting.
+func targetBitrateForRID(rid string) int {
+	switch rid {
+	case "q":
+		return 150_000
+	case "h":
+		return 500_000
+	case "f":
+		return 1_500_000
+	default:
+		return 1_000_000
+	}
+}
+
+// REMBEstimator tracks a smoothed downlink bitrate estimate for one
+// receiver from its RTCP receiver reports: loss above 10% backs the
+// estimate off multiplicatively, otherwise it grows additively, and both
+// are smoothed with the same alpha=0.8 EWMA Google's REMB uses.
+type REMBEstimator struct {
+	mu       sync.Mutex
+	estimate float64 // bits/sec
+}
+
+const (
+	rembAlpha           = 0.8
+	rembLossThreshold   = 0.10
+	rembAdditiveStepBps = 50_000
+	rembInitialEstimate = 1_500_000
+	rembMinimumEstimate = 100_000
+)
+
+// NewREMBEstimator returns an estimator seeded at a generous initial
+// estimate, so a fresh receiver starts on the best layer available and
+// backs off only once loss actually shows up.
+func NewREMBEstimator() *REMBEstimator {
+	return &REMBEstimator{estimate: rembInitialEstimate}
+}
+
+// Update folds in a new loss-fraction sample (0..1) and returns the
+// resulting smoothed estimate in bits/sec.
+func (e *REMBEstimator) Update(lossFraction float64) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var target float64
+	if lossFraction > rembLossThreshold {
+		target = e.estimate * (1 - 0.5*lossFraction) // multiplicative decrease
+	} else {
+		target = e.estimate + rembAdditiveStepBps // additive increase
+	}
+	if target < rembMinimumEstimate {
+		target = rembMinimumEstimate
+	}
+
+	e.estimate = rembAlpha*e.estimate + (1-rembAlpha)*target
+	return e.estimate
+}
+
+// Estimate returns the current smoothed estimate in bits/sec.
+func (e *REMBEstimator) Estimate() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.estimate
+}
+
+// packetMap rewrites a receiver's forwarded sequence numbers and
+// timestamps across a layer switch, so its downTrack - which outlives any
+// number of upstream layer changes - looks like one continuous RTP stream
+// to the decoder even though the packets now originate from a different
+// TrackRemote with its own unrelated counters.
+type packetMap struct {
+	mu          sync.Mutex
+	initialized bool
+	lastRID     string
+	seqOffset   uint16
+	tsOffset    uint32
+	lastOutSeq  uint16
+	lastOutTs   uint32
+}
+
+// tsPerFrame approximates one frame's worth of the 90kHz H264 clock,
+// used to keep timestamps advancing across a switch even though the two
+// layers' encoders aren't frame-aligned.
+const tsPerFrame = 90000 / 30
+
+// rewrite mutates pkt in place so that, if rid differs from the layer this
+// packetMap last saw, its sequence number and timestamp continue on
+// immediately from the last packet this packetMap rewrote.
+func (pm *packetMap) rewrite(rid string, pkt *rtp.Packet) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	switch {
+	case !pm.initialized:
+		pm.initialized = true
+		pm.lastRID = rid
+	case rid != pm.lastRID:
+		pm.seqOffset = pm.lastOutSeq + 1 - pkt.SequenceNumber
+		pm.tsOffset = pm.lastOutTs + tsPerFrame - pkt.Timestamp
+		pm.lastRID = rid
+	}
+
+	pkt.SequenceNumber += pm.seqOffset
+	pkt.Timestamp += pm.tsOffset
+
+	pm.lastOutSeq = pkt.SequenceNumber
+	pm.lastOutTs = pkt.Timestamp
+}
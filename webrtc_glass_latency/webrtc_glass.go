@@ -24,10 +24,30 @@ DataChannel Flow:
 The relay broadcasts timestamp messages to all connected browser clients,
 allowing them to correlate received frames with capture timestamps.
 =============================================================================
+
+=============================================================================
+WHIP/WHEP (RFC 9725): publishers and viewers no longer have to be the one
+hard-coded Python sender and its WebSocket browsers. handleWHIP/handleWHEP
+below let OBS, GStreamer's whipsink, or any WHEP player attach over plain
+HTTP, each to its own named stream. This required pulling senderPC/
+videoTrack/receivers out of Server into a per-stream Stream, keyed by the
+{stream} path segment - /ws and /offer keep working exactly as before by
+operating on a Stream named "default".
+=============================================================================
+
+=============================================================================
+Per-receiver layer selection: forcing every viewer of a simulcast-capable
+publisher onto the same resolution wastes bandwidth on thin links and
+caps it on fat ones. The Stream that used to own one shared videoTrack
+now owns one Layer per RID; each ReceiverClient gets its own downTrack
+plus a REMBEstimator fed from its RTCP receiver reports, and
+runLayerSelector retunes it onto the highest layer its estimate supports
+every 500ms, rewriting the forwarded stream through a packetMap so the
+switch is invisible to the decoder.
+=============================================================================
 */
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -36,8 +56,11 @@ import (
 	"sync"
 	"time"
 
+	"encoding/json"
+
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -72,8 +95,6 @@ type TimestampMessage struct {
 	// For clock sync
 	ClientTime float64 `json:"client_time,omitempty"`
 	ServerTime float64 `json:"server_time,omitempty"`
-	// NEW: Relay adds this timestamp for debugging
-	RelayTimeMs float64 `json:"relay_time_ms,omitempty"`
 }
 
 // END OF NEW TimestampMessage
@@ -92,138 +113,695 @@ type ReceiverClient struct {
 	PC          *webrtc.PeerConnection
 	DataChannel *webrtc.DataChannel // NEW: DataChannel for sending timestamps
 	mu          sync.Mutex
-}
 
-func (r *ReceiverClient) SendTimestamp(msg []byte) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.DataChannel != nil && r.DataChannel.ReadyState() == webrtc.DataChannelStateOpen {
-		// =====================================================================
-		// PREVIOUS CODE (sent binary data - browser couldn't parse):
-		// =====================================================================
-		// if err := r.DataChannel.Send(msg); err != nil {
-		// 	log.Printf("Failed to send timestamp to %s: %v", r.ID, err)
-		// }
-		// =====================================================================
-
-		// =====================================================================
-		// NEW CODE (send as text string for JSON parsing in browser):
-		// =====================================================================
-		// DataChannel.Send([]byte) sends binary data (ArrayBuffer in browser)
-		// DataChannel.SendText(string) sends text data (string in browser)
-		// Since we're sending JSON, we need to send as text
-		if err := r.DataChannel.SendText(string(msg)); err != nil {
-			log.Printf("Failed to send timestamp to %s: %v", r.ID, err)
-		}
-		// =====================================================================
-	}
+	// downTrack is this receiver's own forwarding track, fed by
+	// dispatchToReceivers with this receiver's packetMap rewriting
+	// applied. Each receiver needs a dedicated track rather than sharing
+	// one across a layer, since a shared TrackLocalStaticRTP broadcasts
+	// identical bytes to every binding and offers no hook for the
+	// per-receiver rewriting a layer switch requires.
+	downTrack *webrtc.TrackLocalStaticRTP
+
+	// currentRID is the layer downTrack is currently fed from; chosen and
+	// updated by runLayerSelector.
+	currentRID string
+
+	// pm rewrites seq/timestamp across currentRID switches so downTrack
+	// stays contiguous from the decoder's point of view.
+	pm packetMap
+
+	// estimator smooths this receiver's RTCP receiver reports into a
+	// downlink bandwidth estimate that runLayerSelector picks layers
+	// against.
+	estimator *REMBEstimator
 }
 
+// REMOVED: SendTimestamp used to push a frame_timestamp JSON message down
+// r.DataChannel. That fan-out raced with the RTP it described - a
+// receiver could get the JSON before or after the frame it was about -
+// which made glass-to-glass measurement noisy. Capture time now rides
+// inside the RTP stream itself as an abs-capture-time header extension
+// (see wireSenderTrack/headerExtensionID), so there's nothing left
+// to broadcast out of band.
+
 // END OF NEW ReceiverClient
 // =============================================================================
 
 // =============================================================================
-// Server
+// Stream
 // =============================================================================
 
-type Server struct {
-	upgrader websocket.Upgrader
+// defaultStreamID names the Stream that /ws and /offer operate on, so the
+// original single-sender Python/browser flow keeps working unchanged
+// alongside WHIP/WHEP's named streams.
+const defaultStreamID = "default"
+
+// Stream groups everything that used to live directly on Server for the one
+// hard-coded sender: the publishing PeerConnection and the video track it
+// forwards, plus the browser/WHEP PeerConnections subscribed to it. WHIP
+// creates (or re-publishes into) a Stream keyed by its {stream} path
+// segment, so more than one publisher can be live at once.
+type Stream struct {
+	id string
 
 	// Sender connection
-	senderPC *webrtc.PeerConnection
-	// =========================================================================
-	// REMOVED: senderDC - timestamps now come via WebSocket, not DataChannel
-	// =========================================================================
-	// PREVIOUS:
-	//     senderDC *webrtc.DataChannel // DataChannel from sender
-	//
-	// REASON: Using DataChannel with video track caused "conflicting ice-ufrag"
-	//         errors between aiortc and Pion
-	// =========================================================================
+	senderPC        *webrtc.PeerConnection
 	senderConnected bool
 
-	// =========================================================================
-	// CHANGED: receivers now stores ReceiverClient instead of just PeerConnection
-	// =========================================================================
-	// PREVIOUS (in relay_server_h264.go):
-	//     receivers   map[string]*webrtc.PeerConnection
-	//
-	// NEW: Store ReceiverClient which includes DataChannel
+	// layers holds one Layer per RID the publisher is sending - a single
+	// entry keyed by "" for a publisher that isn't simulcasting.
+	layers   map[string]*Layer
+	layersMu sync.RWMutex
+
 	receivers   map[string]*ReceiverClient
 	receiversMu sync.RWMutex
-	// =========================================================================
 
-	// Video track
-	videoTrack *webrtc.TrackLocalStaticRTP
+	// packetCache holds the last packetCacheSize RTP packets forwarded to
+	// any layer, so a receiver's Generic NACK can be served by
+	// retransmission instead of waiting out the next PLI.
+	packetCache *PacketCache
 
-	// Synchronization
+	// stats holds the most recent RTCP receiver report per receiver ID,
+	// surfaced by handleConfig as a per-receiver loss rate.
+	statsMu sync.Mutex
+	stats   map[string]*ReceiverStats
+
+	// recorder persists this stream's forwarded H264 to disk when
+	// enabled via /record/{stream}/start; nil while recording is off.
+	recorderMu sync.Mutex
+	recorder   *Recorder
+
+	// captureTimes holds the capture_ms the sender reported per RTP
+	// timestamp over /ws, consumed by wireSenderTrack to stamp each
+	// forwarded packet with an abs-capture-time header extension.
+	captureTimes *captureTimeCache
+
+	// Synchronization for senderPC/senderConnected above
 	mu sync.Mutex
+}
+
+// ReceiverStats is the most recently observed RTCP receiver report for one
+// receiver, plus the bandwidth estimate and layer it most recently drove
+// runLayerSelector to pick.
+type ReceiverStats struct {
+	LossFraction float64   `json:"loss_fraction"`
+	Jitter       uint32    `json:"jitter"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Layer        string    `json:"layer,omitempty"`
+	EstimateBps  float64   `json:"estimate_bps,omitempty"`
+}
+
+func newStream(id string) *Stream {
+	return &Stream{
+		id:           id,
+		layers:       make(map[string]*Layer),
+		receivers:    make(map[string]*ReceiverClient),
+		packetCache:  NewPacketCache(),
+		stats:        make(map[string]*ReceiverStats),
+		captureTimes: newCaptureTimeCache(),
+	}
+}
+
+// getOrCreateLayer returns st's Layer for rid, creating its forwarding
+// track on first use.
+func (st *Stream) getOrCreateLayer(rid string) (*Layer, error) {
+	st.layersMu.RLock()
+	l, ok := st.layers[rid]
+	st.layersMu.RUnlock()
+	if ok {
+		return l, nil
+	}
+
+	track, err := newH264ForwardingTrack()
+	if err != nil {
+		return nil, err
+	}
+
+	st.layersMu.Lock()
+	defer st.layersMu.Unlock()
+	if l, ok := st.layers[rid]; ok {
+		return l, nil
+	}
+	l = &Layer{rid: rid, track: track, targetBitrate: targetBitrateForRID(rid)}
+	st.layers[rid] = l
+	return l, nil
+}
+
+// hasLayers reports whether the publisher has sent any video yet.
+func (st *Stream) hasLayers() bool {
+	st.layersMu.RLock()
+	defer st.layersMu.RUnlock()
+	return len(st.layers) > 0
+}
+
+// bestLayer returns st's highest-bitrate layer, or nil if the publisher
+// hasn't sent any video yet.
+func (st *Stream) bestLayer() *Layer {
+	st.layersMu.RLock()
+	defer st.layersMu.RUnlock()
+
+	var best *Layer
+	for _, l := range st.layers {
+		if best == nil || l.targetBitrate > best.targetBitrate {
+			best = l
+		}
+	}
+	return best
+}
+
+// layerFor picks the highest-bitrate layer whose targetBitrate fits within
+// estimateBps, falling back to the lowest-bitrate layer available if the
+// estimate can't support any of them.
+func (st *Stream) layerFor(estimateBps float64) *Layer {
+	st.layersMu.RLock()
+	defer st.layersMu.RUnlock()
+
+	var best, lowest *Layer
+	for _, l := range st.layers {
+		if lowest == nil || l.targetBitrate < lowest.targetBitrate {
+			lowest = l
+		}
+		if float64(l.targetBitrate) <= estimateBps && (best == nil || l.targetBitrate > best.targetBitrate) {
+			best = l
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return lowest
+}
+
+// clearLayers drops every layer, called when the publisher disconnects so
+// a reconnect starts from a clean set of tracks.
+func (st *Stream) clearLayers() {
+	st.layersMu.Lock()
+	st.layers = make(map[string]*Layer)
+	st.layersMu.Unlock()
+}
+
+// recordReceiverReport updates receiverID's loss/jitter stats from an RTCP
+// receiver report, and folds the loss fraction into that receiver's
+// REMBEstimator so runLayerSelector can react to it.
+func (st *Stream) recordReceiverReport(receiverID string, report rtcp.ReceptionReport) {
+	lossFraction := float64(report.FractionLost) / 256
+
+	st.receiversMu.RLock()
+	recv := st.receivers[receiverID]
+	st.receiversMu.RUnlock()
+
+	var estimate float64
+	var layer string
+	if recv != nil && recv.estimator != nil {
+		estimate = recv.estimator.Update(lossFraction)
+		recv.mu.Lock()
+		layer = recv.currentRID
+		recv.mu.Unlock()
+	}
+
+	st.statsMu.Lock()
+	defer st.statsMu.Unlock()
+	st.stats[receiverID] = &ReceiverStats{
+		LossFraction: lossFraction,
+		Jitter:       report.Jitter,
+		UpdatedAt:    time.Now(),
+		Layer:        layer,
+		EstimateBps:  estimate,
+	}
+}
+
+// receiverStatsSnapshot returns a copy of every receiver's most recent
+// stats, safe to hand to a JSON encoder without holding statsMu.
+func (st *Stream) receiverStatsSnapshot() map[string]ReceiverStats {
+	st.statsMu.Lock()
+	defer st.statsMu.Unlock()
+
+	out := make(map[string]ReceiverStats, len(st.stats))
+	for id, s := range st.stats {
+		out[id] = *s
+	}
+	return out
+}
+
+// forgetReceiverStats drops receiverID's stats entry, called alongside
+// removeReceiver.
+func (st *Stream) forgetReceiverStats(receiverID string) {
+	st.statsMu.Lock()
+	delete(st.stats, receiverID)
+	st.statsMu.Unlock()
+}
+
+// REMOVED: BroadcastTimestamp used to fan a frame_timestamp JSON message
+// out to every receiver's DataChannel each time the Python sender reported
+// one over /ws. See the REMOVED note above ReceiverClient for why that
+// hot path is gone: capture time is now carried in-band as an
+// abs-capture-time RTP header extension, recorded into
+// Stream.recordCaptureTime and injected by wireSenderTrack's forwarding
+// goroutine instead.
+
+// recordCaptureTime notes the capture_ms the sender reported for
+// rtpTimestamp over /ws, for wireSenderTrack to pick up via captureTime
+// once the matching RTP packet is forwarded.
+func (st *Stream) recordCaptureTime(rtpTimestamp uint32, captureMs float64) {
+	st.captureTimes.record(rtpTimestamp, captureMs)
+}
+
+// captureTime returns the capture_ms recorded for rtpTimestamp, if the
+// sender reported one.
+func (st *Stream) captureTime(rtpTimestamp uint32) (float64, bool) {
+	return st.captureTimes.lookup(rtpTimestamp)
+}
+
+// newH264ForwardingTrack creates a local track with the H264 RTP
+// parameters this relay forwards video with - used both for a Stream's
+// per-layer forwarding track and for each receiver's own downTrack.
+func newH264ForwardingTrack() (*webrtc.TrackLocalStaticRTP, error) {
+	return webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		},
+		"video",
+		"stream",
+	)
+}
+
+// wireSenderTrack registers the OnTrack handler that turns an inbound H264
+// track from a publisher - the Python sender over /ws, or a WHIP client -
+// into a Layer keyed by the track's RID (a simulcast publisher fires
+// OnTrack once per encoding; a non-simulcast one fires it once with
+// RID ""), requests keyframes from the publisher, and forwards RTP to
+// every receiver currently tuned to that layer. Shared by handleWebSocket
+// and handleWHIP since both terminate in the same Stream/PeerConnection
+// relationship; only the signaling transport differs.
+func (st *Stream) wireSenderTrack(pc *webrtc.PeerConnection) {
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("Received track from sender - Kind: %s, Codec: %s, PT: %d, RID: %q",
+			track.Kind(), track.Codec().MimeType, track.PayloadType(), track.RID())
+
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
+		}
+
+		captureTimeExtID := headerExtensionID(receiver, absCaptureTimeURI)
+
+		rid := track.RID()
+		log.Printf("Creating local video track for forwarding (RID=%q)...", rid)
+
+		layer, err := st.getOrCreateLayer(rid)
+		if err != nil {
+			log.Println("Failed to create local track:", err)
+			return
+		}
+
+		log.Printf("Local H264 video track created (RID=%q)", rid)
+
+		st.receiversMu.RLock()
+		for id, recv := range st.receivers {
+			recv.mu.Lock()
+			needsTrack := recv.downTrack == nil && recv.PC.ConnectionState() == webrtc.PeerConnectionStateConnected
+			recv.mu.Unlock()
+			if needsTrack {
+				if _, err := recv.PC.AddTrack(layer.track); err != nil {
+					log.Printf("Failed to add track to receiver %s: %v", id, err)
+				}
+			}
+		}
+		st.receiversMu.RUnlock()
+
+		hasKeyframe := false
+		keyframeMutex := &sync.Mutex{}
+
+		// Request initial keyframe
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			if err := pc.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{
+					MediaSSRC: uint32(track.SSRC()),
+				},
+			}); err != nil {
+				log.Printf("Failed to request initial keyframe: %v", err)
+			} else {
+				log.Println("Initial H264 IDR frame request sent")
+			}
+		}()
+
+		// Periodic keyframe requests
+		go func() {
+			ticker := time.NewTicker(3 * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				keyframeMutex.Lock()
+				needsKeyframe := !hasKeyframe
+				keyframeMutex.Unlock()
+
+				if needsKeyframe && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+					if err := pc.WriteRTCP([]rtcp.Packet{
+						&rtcp.PictureLossIndication{
+							MediaSSRC: uint32(track.SSRC()),
+						},
+					}); err != nil {
+						log.Printf("Failed to send PLI: %v", err)
+					}
+				}
+			}
+		}()
+
+		// Forward RTP packets
+		go func() {
+			packetCount := 0
+
+			for {
+				rtpPacket, _, readErr := track.ReadRTP()
+				if readErr != nil {
+					if readErr != io.EOF {
+						log.Printf("Error reading RTP: %v", readErr)
+					}
+					return
+				}
+
+				packetCount++
+
+				// H264 keyframe detection
+				isKeyframe := false
+				if len(rtpPacket.Payload) > 0 {
+					nalType := rtpPacket.Payload[0] & 0x1F
+
+					switch nalType {
+					case 5, 7, 8:
+						isKeyframe = true
+					case 24:
+						if len(rtpPacket.Payload) > 3 {
+							innerNalType := rtpPacket.Payload[3] & 0x1F
+							if innerNalType == 5 || innerNalType == 7 || innerNalType == 8 {
+								isKeyframe = true
+							}
+						}
+					}
+
+					if isKeyframe {
+						keyframeMutex.Lock()
+						if !hasKeyframe {
+							log.Printf("First H264 keyframe received at packet #%d!", packetCount)
+							hasKeyframe = true
+						}
+						keyframeMutex.Unlock()
+					}
+				}
+
+				if packetCount%500 == 0 {
+					log.Printf("Forwarded %d H264 packets", packetCount)
+				}
+
+				if captureTimeExtID != 0 {
+					if captureMs, ok := st.captureTime(rtpPacket.Timestamp); ok {
+						if err := rtpPacket.SetExtension(captureTimeExtID, encodeAbsCaptureTime(captureMs)); err != nil {
+							log.Printf("Failed to set abs-capture-time extension: %v", err)
+						}
+					}
+				}
+
+				if raw, err := rtpPacket.Marshal(); err == nil {
+					st.packetCache.Store(rtpPacket.SequenceNumber, raw)
+				}
+
+				st.recorderMu.Lock()
+				rec := st.recorder
+				st.recorderMu.Unlock()
+				if rec != nil {
+					rec.WriteRTP(rtpPacket, isKeyframe, func() {
+						pc.WriteRTCP([]rtcp.Packet{
+							&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+						})
+					})
+				}
+
+				st.dispatchToReceivers(rid, rtpPacket)
+			}
+		}()
+	})
+}
+
+// dispatchToReceivers forwards one packet read from the rid layer to
+// every receiver currently tuned to that layer, rewriting each through
+// the receiver's own packetMap so a later layer switch stays contiguous
+// for that receiver's decoder.
+func (st *Stream) dispatchToReceivers(rid string, pkt *rtp.Packet) {
+	st.receiversMu.RLock()
+	defer st.receiversMu.RUnlock()
+
+	for id, recv := range st.receivers {
+		recv.mu.Lock()
+		tuned := recv.currentRID == rid
+		downTrack := recv.downTrack
+		recv.mu.Unlock()
+
+		if !tuned || downTrack == nil {
+			continue
+		}
+
+		out := *pkt
+		recv.pm.rewrite(rid, &out)
+		if err := downTrack.WriteRTP(&out); err != nil && err != io.ErrClosedPipe {
+			log.Printf("Error forwarding RTP to receiver %s: %v", id, err)
+		}
+	}
+}
+
+// layerSelectInterval is how often runLayerSelector re-evaluates a
+// receiver's layer against its current bandwidth estimate.
+const layerSelectInterval = 500 * time.Millisecond
+
+// runLayerSelector periodically retunes receiver onto the best layer st
+// can offer within its current REMBEstimator estimate, requesting a fresh
+// keyframe from the publisher on every switch so the new layer starts
+// from a decodable frame. Exits once receiver's downTrack is gone
+// (receiver torn down).
+func (st *Stream) runLayerSelector(receiver *ReceiverClient) {
+	ticker := time.NewTicker(layerSelectInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		receiver.mu.Lock()
+		stillActive := receiver.downTrack != nil
+		receiver.mu.Unlock()
+		if !stillActive {
+			return
+		}
+
+		layer := st.layerFor(receiver.estimator.Estimate())
+		if layer == nil {
+			continue
+		}
+
+		receiver.mu.Lock()
+		changed := receiver.currentRID != layer.rid
+		if changed {
+			receiver.currentRID = layer.rid
+		}
+		receiver.mu.Unlock()
+
+		if changed {
+			log.Printf("Receiver %s switched to layer %q (estimate=%.0fbps)",
+				receiver.ID, layer.rid, receiver.estimator.Estimate())
+			st.requestKeyframeFromSender()
+		}
+	}
+}
+
+// wireReceiverDataChannel registers the OnDataChannel handler that accepts
+// the "timestamps" DataChannel a browser/WHEP client includes in its offer
+// and wires up clock-sync pong replies. Shared by handleOffer and
+// handleWHEP.
+func (st *Stream) wireReceiverDataChannel(pc *webrtc.PeerConnection, receiver *ReceiverClient) {
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		log.Printf("📡 Received DataChannel from receiver %s: '%s'", receiver.ID, dc.Label())
+
+		if dc.Label() != "timestamps" {
+			log.Printf("⚠️ Received unexpected DataChannel '%s' from receiver %s", dc.Label(), receiver.ID)
+			return
+		}
+
+		log.Printf("📡 Assigning timestamps DataChannel to receiver %s", receiver.ID)
+		receiver.mu.Lock()
+		receiver.DataChannel = dc
+		receiver.mu.Unlock()
+
+		dc.OnOpen(func() {
+			log.Printf("📡 Receiver %s DataChannel OPEN", receiver.ID)
+		})
+
+		dc.OnClose(func() {
+			log.Printf("📡 Receiver %s DataChannel CLOSED", receiver.ID)
+		})
+
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var tsMsg TimestampMessage
+			if err := json.Unmarshal(msg.Data, &tsMsg); err != nil {
+				log.Printf("⚠️ Failed to parse DataChannel message from receiver: %v", err)
+				return
+			}
+
+			if tsMsg.Type != "ping" {
+				return
+			}
+
+			log.Printf("🕐 Receiver %s clock sync ping received, sending pong", receiver.ID)
+			pong := TimestampMessage{
+				Type:       "pong",
+				ClientTime: tsMsg.ClientTime,
+				ServerTime: float64(time.Now().UnixNano()) / 1e6,
+			}
+			pongBytes, _ := json.Marshal(pong)
+			if err := dc.SendText(string(pongBytes)); err != nil {
+				log.Printf("⚠️ Failed to send pong to %s: %v", receiver.ID, err)
+			}
+		})
+	})
+}
+
+// requestKeyframeFromSender asks st's publisher for a fresh keyframe on
+// every video track (every simulcast layer) it is sending, used whenever a
+// new receiver connects so it doesn't have to wait for the next periodic
+// PLI, and whenever runLayerSelector switches a receiver's layer.
+func (st *Stream) requestKeyframeFromSender() {
+	st.mu.Lock()
+	senderPC := st.senderPC
+	st.mu.Unlock()
+
+	if senderPC == nil {
+		return
+	}
+	for _, recv := range senderPC.GetReceivers() {
+		for _, track := range recv.Tracks() {
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				senderPC.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{
+						MediaSSRC: uint32(track.SSRC()),
+					},
+				})
+			}
+		}
+	}
+}
+
+// removeReceiver tears down and forgets the receiver with the given id, if
+// any. Safe to call with an id that's already gone.
+func (st *Stream) removeReceiver(id string) {
+	if id == "" {
+		return
+	}
+	st.receiversMu.Lock()
+	receiver, ok := st.receivers[id]
+	delete(st.receivers, id)
+	st.receiversMu.Unlock()
+
+	st.forgetReceiverStats(id)
+
+	if ok {
+		// Clearing downTrack is what stops this receiver's runLayerSelector.
+		receiver.mu.Lock()
+		receiver.downTrack = nil
+		receiver.mu.Unlock()
+	}
+
+	if ok && receiver.PC != nil {
+		receiver.PC.Close()
+	}
+}
+
+// =============================================================================
+// Server
+// =============================================================================
+
+type Server struct {
+	upgrader websocket.Upgrader
+
+	// streams holds every Stream this relay knows about, keyed by the
+	// {stream} path segment used by /whip, /whep, /ws, and /offer -
+	// defaultStreamID for the latter two.
+	streamsMu sync.RWMutex
+	streams   map[string]*Stream
 
 	// Configuration
 	senderURL string
+
+	// api builds every PeerConnection through the SettingEngine ice.json
+	// describes (ephemeral port range, NAT 1:1, ICE-lite), instead of the
+	// zero-value webrtc.API.
+	api *webrtc.API
+
+	// iceConfig holds the live ICE server list, reloaded on SIGHUP so
+	// TURN REST credentials can rotate without a restart.
+	iceConfig *iceConfigStore
 }
 
 func NewServer(senderURL string) *Server {
+	iceConfig := newICEConfigStore()
+	iceConfig.watchSIGHUP()
+
+	m, err := newCaptureTimeMediaEngine()
+	if err != nil {
+		log.Fatalf("Failed to build MediaEngine: %v", err)
+	}
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithSettingEngine(iceConfig.get().settingEngine()),
+	)
+
 	return &Server{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		},
-		// CHANGED: Initialize with ReceiverClient map
-		receivers: make(map[string]*ReceiverClient),
+		streams:   make(map[string]*Stream),
 		senderURL: senderURL,
+		api:       api,
+		iceConfig: iceConfig,
 	}
 }
 
-// =============================================================================
-// NEW: BroadcastTimestamp sends timestamp message to all connected browsers
-// =============================================================================
-// PREVIOUS (in relay_server_h264.go): (not present)
-//
-// NEW: Method to broadcast timestamp messages to all browser clients
-func (s *Server) BroadcastTimestamp(msg []byte) {
-	s.receiversMu.RLock()
-	defer s.receiversMu.RUnlock()
+// newPeerConnection creates a PeerConnection through s.api, configured
+// with s.iceConfig's current ICE servers plus any extraServers a caller
+// parsed from a WHIP/WHEP Link header. role is "sender"/"publisher" or
+// "receiver"/"viewer", used only for error context.
+func (s *Server) newPeerConnection(role string, extraServers []webrtc.ICEServer) (*webrtc.PeerConnection, error) {
+	servers := append(s.iceConfig.get().webrtcICEServers(), extraServers...)
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	if err != nil {
+		return nil, fmt.Errorf("newPeerConnection(%s): %w", role, err)
+	}
+	return pc, nil
+}
 
-	// =========================================================================
-	// PREVIOUS CODE (simple loop):
-	// =========================================================================
-	// for _, receiver := range s.receivers {
-	// 	receiver.SendTimestamp(msg)
-	// }
-	// =========================================================================
+// whipWhepICEServers returns the ICE servers this relay currently offers
+// WHIP/WHEP clients, per the live ice.json config.
+func (s *Server) whipWhepICEServers() []webrtc.ICEServer {
+	return s.iceConfig.get().webrtcICEServers()
+}
 
-	// =========================================================================
-	// NEW CODE (with debug logging and state checking):
-	// =========================================================================
-	receiverCount := len(s.receivers)
-	sentCount := 0
-
-	for id, receiver := range s.receivers {
-		if receiver.DataChannel != nil && receiver.DataChannel.ReadyState() == webrtc.DataChannelStateOpen {
-			receiver.SendTimestamp(msg)
-			sentCount++
-		} else {
-			dcState := "nil"
-			if receiver.DataChannel != nil {
-				dcState = receiver.DataChannel.ReadyState().String()
-			}
-			log.Printf("⚠️ Cannot send timestamp to %s: DataChannel state=%s", id, dcState)
-		}
+// stream returns the Stream named id, creating it on first use.
+func (s *Server) stream(id string) *Stream {
+	s.streamsMu.RLock()
+	st, ok := s.streams[id]
+	s.streamsMu.RUnlock()
+	if ok {
+		return st
 	}
 
-	// Log every 30th timestamp (roughly once per second at 30fps)
-	if sentCount > 0 && receiverCount > 0 {
-		// Periodic logging handled elsewhere
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if st, ok := s.streams[id]; ok {
+		return st
 	}
-	// =========================================================================
+	st = newStream(id)
+	s.streams[id] = st
+	return st
 }
 
-// END OF NEW BroadcastTimestamp
-// =============================================================================
-
 // =============================================================================
 // WebSocket Handler (Python Sender)
 // =============================================================================
@@ -257,29 +835,21 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("WebSocket connection established with sender")
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"stun:stun1.l.google.com:19302"}},
-		},
-	}
-
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := s.newPeerConnection("sender", nil)
 	if err != nil {
 		log.Println("Failed to create PeerConnection:", err)
 		return
 	}
 	defer pc.Close()
 
-	s.mu.Lock()
-	s.senderPC = pc
-	s.senderConnected = true
-	s.mu.Unlock()
+	st := s.stream(defaultStreamID)
 
-	log.Println("Sender PeerConnection created")
+	st.mu.Lock()
+	st.senderPC = pc
+	st.senderConnected = true
+	st.mu.Unlock()
 
-	hasKeyframe := false
-	keyframeMutex := &sync.Mutex{}
+	log.Println("Sender PeerConnection created")
 
 	// =========================================================================
 	// CHANGED: Timestamps come via WebSocket, NOT DataChannel
@@ -301,150 +871,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Timestamps are now processed in the WebSocket message handler below
 	// =========================================================================
 
-	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Received track from sender - Kind: %s, Codec: %s, PT: %d",
-			track.Kind(), track.Codec().MimeType, track.PayloadType())
-
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			log.Println("Creating local video track for forwarding...")
-
-			localTrack, err := webrtc.NewTrackLocalStaticRTP(
-				webrtc.RTPCodecCapability{
-					MimeType:    webrtc.MimeTypeH264,
-					ClockRate:   90000,
-					SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-				},
-				"video",
-				"stream",
-			)
-			if err != nil {
-				log.Println("Failed to create local track:", err)
-				return
-			}
-
-			s.mu.Lock()
-			s.videoTrack = localTrack
-			s.mu.Unlock()
-
-			log.Println("Local H264 video track created")
-
-			// =====================================================================
-			// CHANGED: Updated to use ReceiverClient instead of PeerConnection
-			// =====================================================================
-			// PREVIOUS (in relay_server_h264.go):
-			//     s.receiversMu.RLock()
-			//     for id, receiverPC := range s.receivers {
-			//         if receiverPC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-			//             _, err := receiverPC.AddTrack(localTrack)
-			//
-			// NEW: Access PeerConnection through ReceiverClient
-			s.receiversMu.RLock()
-			for id, receiver := range s.receivers {
-				if receiver.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-					_, err := receiver.PC.AddTrack(localTrack)
-					if err != nil {
-						log.Printf("Failed to add track to receiver %s: %v", id, err)
-					}
-				}
-			}
-			s.receiversMu.RUnlock()
-			// =====================================================================
-
-			// Request initial keyframe (unchanged)
-			go func() {
-				time.Sleep(500 * time.Millisecond)
-				if err := pc.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: uint32(track.SSRC()),
-					},
-				}); err != nil {
-					log.Printf("Failed to request initial keyframe: %v", err)
-				} else {
-					log.Println("Initial H264 IDR frame request sent")
-				}
-			}()
-
-			// Periodic keyframe requests (unchanged)
-			go func() {
-				ticker := time.NewTicker(3 * time.Second)
-				defer ticker.Stop()
-
-				for range ticker.C {
-					keyframeMutex.Lock()
-					needsKeyframe := !hasKeyframe
-					keyframeMutex.Unlock()
-
-					if needsKeyframe && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
-						if err := pc.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{
-								MediaSSRC: uint32(track.SSRC()),
-							},
-						}); err != nil {
-							log.Printf("Failed to send PLI: %v", err)
-						}
-					}
-				}
-			}()
-
-			// Forward RTP packets (unchanged)
-			go func() {
-				packetCount := 0
-
-				for {
-					rtpPacket, _, readErr := track.ReadRTP()
-					if readErr != nil {
-						if readErr != io.EOF {
-							log.Printf("Error reading RTP: %v", readErr)
-						}
-						return
-					}
-
-					packetCount++
-
-					// H264 keyframe detection (unchanged)
-					if len(rtpPacket.Payload) > 0 {
-						nalType := rtpPacket.Payload[0] & 0x1F
-						isKeyframe := false
-
-						switch nalType {
-						case 5, 7, 8:
-							isKeyframe = true
-						case 24:
-							if len(rtpPacket.Payload) > 3 {
-								innerNalType := rtpPacket.Payload[3] & 0x1F
-								if innerNalType == 5 || innerNalType == 7 || innerNalType == 8 {
-									isKeyframe = true
-								}
-							}
-						}
-
-						if isKeyframe {
-							keyframeMutex.Lock()
-							if !hasKeyframe {
-								log.Printf("First H264 keyframe received at packet #%d!", packetCount)
-								hasKeyframe = true
-							}
-							keyframeMutex.Unlock()
-						}
-					}
-
-					if packetCount%500 == 0 {
-						log.Printf("Forwarded %d H264 packets", packetCount)
-					}
-
-					s.mu.Lock()
-					if s.videoTrack != nil {
-						if err := s.videoTrack.WriteRTP(rtpPacket); err != nil && err != io.ErrClosedPipe {
-							if packetCount%100 == 0 {
-								log.Printf("Error writing RTP: %v", err)
-							}
-						}
-					}
-					s.mu.Unlock()
-				}
-			}()
-		}
-	})
+	st.wireSenderTrack(pc)
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil {
@@ -575,36 +1002,19 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			// Add relay timestamp for debugging
-			tsMsg.RelayTimeMs = float64(time.Now().UnixNano()) / 1e6
-
-			// Re-encode with relay timestamp
-			enrichedMsg, err := json.Marshal(tsMsg)
-			if err != nil {
-				log.Printf("Failed to re-encode timestamp: %v", err)
-				continue
-			}
-
-			// =============================================================
-			// PREVIOUS CODE (no logging):
-			// =============================================================
-			// // Broadcast to all browser clients via DataChannel
-			// s.BroadcastTimestamp(enrichedMsg)
-			// =============================================================
-
 			// =============================================================
-			// NEW CODE (with periodic debug logging):
+			// REMOVED: this used to add a RelayTimeMs debug field, re-encode
+			// tsMsg to JSON, and st.BroadcastTimestamp it to every browser's
+			// DataChannel. Capture time now travels with the RTP packet it
+			// describes instead (see Stream.recordCaptureTime and
+			// wireSenderTrack), so all that's left to do here is record it
+			// against the RTP timestamp it corresponds to.
 			// =============================================================
-			// Log periodically (every 30 timestamps = ~1 second at 30fps)
 			if tsMsg.FrameNum%30 == 0 {
-				s.receiversMu.RLock()
-				numReceivers := len(s.receivers)
-				s.receiversMu.RUnlock()
-				log.Printf("📡 Timestamp frame=%d, broadcasting to %d receivers", tsMsg.FrameNum, numReceivers)
+				log.Printf("📡 Timestamp frame=%d pts=%d capture_ms=%.3f", tsMsg.FrameNum, tsMsg.Pts, tsMsg.CaptureMs)
 			}
 
-			// Broadcast to all browser clients via DataChannel
-			s.BroadcastTimestamp(enrichedMsg)
+			st.recordCaptureTime(uint32(tsMsg.Pts), tsMsg.CaptureMs)
 			// =============================================================
 		// =================================================================
 
@@ -616,11 +1026,11 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// =========================================================================
 	// Cleanup (senderDC removed - using WebSocket for timestamps)
 	// =========================================================================
-	s.mu.Lock()
-	s.senderConnected = false
-	s.senderPC = nil
-	s.videoTrack = nil
-	s.mu.Unlock()
+	st.mu.Lock()
+	st.senderConnected = false
+	st.senderPC = nil
+	st.mu.Unlock()
+	st.clearLayers()
 	// =========================================================================
 
 	log.Println("Sender disconnected")
@@ -648,12 +1058,13 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	s.mu.Lock()
-	senderConnected := s.senderConnected
-	videoTrack := s.videoTrack
-	s.mu.Unlock()
+	st := s.stream(defaultStreamID)
 
-	if !senderConnected || videoTrack == nil {
+	st.mu.Lock()
+	senderConnected := st.senderConnected
+	st.mu.Unlock()
+
+	if !senderConnected || !st.hasLayers() {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -668,14 +1079,7 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"stun:stun1.l.google.com:19302"}},
-		},
-	}
-
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := s.newPeerConnection("receiver", nil)
 	if err != nil {
 		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
 		return
@@ -693,9 +1097,20 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	//     s.receiversMu.Unlock()
 	//
 	// NEW: Create ReceiverClient with DataChannel
+	downTrack, err := newH264ForwardingTrack()
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
 	receiver := &ReceiverClient{
-		ID: receiverID,
-		PC: pc,
+		ID:        receiverID,
+		PC:        pc,
+		downTrack: downTrack,
+		estimator: NewREMBEstimator(),
+	}
+	if best := st.bestLayer(); best != nil {
+		receiver.currentRID = best.rid
 	}
 	// =========================================================================
 
@@ -726,97 +1141,14 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	// Browser includes DataChannel in its offer, server receives it here.
 	// This ensures proper SDP negotiation and DataChannel opens correctly.
 	log.Printf("Setting up OnDataChannel handler for %s", receiverID)
-	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		log.Printf("📡 Received DataChannel from browser %s: '%s'", receiverID, dc.Label())
-
-		if dc.Label() == "timestamps" {
-			log.Printf("📡 Assigning timestamps DataChannel to receiver %s", receiverID)
-			receiver.mu.Lock()
-			receiver.DataChannel = dc
-			receiver.mu.Unlock()
-
-			dc.OnOpen(func() {
-				log.Printf("📡 Browser %s DataChannel OPEN", receiverID)
-			})
-
-			dc.OnClose(func() {
-				log.Printf("📡 Browser %s DataChannel CLOSED", receiverID)
-			})
-
-			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-				// Handle clock sync pings from browser
-				var tsMsg TimestampMessage
-				// =============================================================
-				// PREVIOUS CODE (silent error handling):
-				// =============================================================
-				// if err := json.Unmarshal(msg.Data, &tsMsg); err != nil {
-				// 	return
-				// }
-				// =============================================================
-
-				// =============================================================
-				// NEW CODE (with error logging):
-				// =============================================================
-				if err := json.Unmarshal(msg.Data, &tsMsg); err != nil {
-					log.Printf("⚠️ Failed to parse DataChannel message from browser: %v", err)
-					return
-				}
-				// =============================================================
-
-				if tsMsg.Type == "ping" {
-					// ==========================================================
-					// PREVIOUS CODE (silent pong):
-					// ==========================================================
-					// // Respond with server time for clock sync
-					// pong := TimestampMessage{
-					// 	Type:       "pong",
-					// 	ClientTime: tsMsg.ClientTime,
-					// 	ServerTime: float64(time.Now().UnixNano()) / 1e6,
-					// }
-					// pongBytes, _ := json.Marshal(pong)
-					// dc.Send(pongBytes)
-					// ==========================================================
-
-					// ==========================================================
-					// NEW CODE (with debug logging):
-					// ==========================================================
-					log.Printf("🕐 Browser %s clock sync ping received, sending pong", receiverID)
-					// Respond with server time for clock sync
-					pong := TimestampMessage{
-						Type:       "pong",
-						ClientTime: tsMsg.ClientTime,
-						ServerTime: float64(time.Now().UnixNano()) / 1e6,
-					}
-					pongBytes, _ := json.Marshal(pong)
-					// ======================================================
-					// PREVIOUS CODE (sent binary - browser couldn't parse):
-					// ======================================================
-					// if err := dc.Send(pongBytes); err != nil {
-					// 	log.Printf("⚠️ Failed to send pong to %s: %v", receiverID, err)
-					// }
-					// ======================================================
-
-					// ======================================================
-					// NEW CODE (send as text for JSON parsing in browser):
-					// ======================================================
-					if err := dc.SendText(string(pongBytes)); err != nil {
-						log.Printf("⚠️ Failed to send pong to %s: %v", receiverID, err)
-					}
-					// ======================================================
-					// ==========================================================
-				}
-			})
-		} else {
-			log.Printf("⚠️ Received unexpected DataChannel '%s' from browser %s", dc.Label(), receiverID)
-		}
-	})
+	st.wireReceiverDataChannel(pc, receiver)
 	log.Printf("OnDataChannel handler registered for %s", receiverID)
 	// END OF NEW DataChannel handling
 	// =========================================================================
 
-	s.receiversMu.Lock()
-	s.receivers[receiverID] = receiver
-	s.receiversMu.Unlock()
+	st.receiversMu.Lock()
+	st.receivers[receiverID] = receiver
+	st.receiversMu.Unlock()
 
 	// =======================================================================
 	// CHANGED: Updated log message (DataChannel comes from browser now)
@@ -834,40 +1166,21 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 			log.Printf("✓ BROWSER %s CONNECTED (H264 + timestamps)!", receiverID)
 
 			// Request keyframe (unchanged)
-			if s.senderPC != nil {
-				for _, recv := range s.senderPC.GetReceivers() {
-					if recv.Track() != nil && recv.Track().Kind() == webrtc.RTPCodecTypeVideo {
-						s.senderPC.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{
-								MediaSSRC: uint32(recv.Track().SSRC()),
-							},
-						})
-						break
-					}
-				}
-			}
+			st.requestKeyframeFromSender()
 		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
-			s.receiversMu.Lock()
-			delete(s.receivers, receiverID)
-			s.receiversMu.Unlock()
+			st.removeReceiver(receiverID)
 		}
 	})
 
-	// Add video track (unchanged)
-	rtpSender, err := pc.AddTrack(videoTrack)
+	// Add this receiver's own down-track (CHANGED: was the Stream's
+	// single shared videoTrack; see runLayerSelector)
+	rtpSender, err := pc.AddTrack(downTrack)
 	if err != nil {
 		http.Error(w, "Failed to add track", http.StatusInternalServerError)
 		return
 	}
-
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, err := rtpSender.Read(rtcpBuf); err != nil {
-				return
-			}
-		}
-	}()
+	go st.handleReceiverRTCP(rtpSender, receiverID)
+	go st.runLayerSelector(receiver)
 
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
@@ -950,13 +1263,469 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	log.Println("Answer sent to browser (includes DataChannel)")
 }
 
+// handleReceiverRTCP reads RTCP from a receiver's RTPSender - which pion
+// requires callers to keep reading to avoid blocking - parsing it instead
+// of discarding it: a Generic NACK (RFC 4585 FMT=1) is served from
+// st.packetCache, and receiver reports update st's per-receiver loss stats.
+func (st *Stream) handleReceiverRTCP(rtpSender *webrtc.RTPSender, receiverID string) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := rtpSender.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, pkt := range packets {
+			switch p := pkt.(type) {
+			case *rtcp.TransportLayerNack:
+				st.resendNacked(p)
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					st.recordReceiverReport(receiverID, report)
+				}
+			}
+		}
+	}
+}
+
+// resendNacked re-sends every packet a Generic NACK asked for, pulling raw
+// bytes out of st.packetCache and handing each one to dispatchToReceivers
+// for the highest-bitrate layer - the same fan-out live forwarding uses,
+// so a resend reaches every receiver's own downTrack (rewritten through
+// its packetMap) rather than the layer's track directly, which no
+// receiver is ever bound to. That fans the retransmit out to every
+// receiver currently tuned to that layer rather than just the one that
+// lost it, but a spurious resend to a receiver that already has the
+// packet, or one tuned to a different layer, is harmless.
+func (st *Stream) resendNacked(nack *rtcp.TransportLayerNack) {
+	layer := st.bestLayer()
+	if layer == nil {
+		return
+	}
+
+	buf := make([]byte, 1500)
+	for _, pair := range nack.Nacks {
+		for _, seqno := range pair.PacketList() {
+			n := st.packetCache.Get(seqno, buf)
+			if n == 0 {
+				continue
+			}
+
+			var pkt rtp.Packet
+			if err := pkt.Unmarshal(buf[:n]); err != nil {
+				continue
+			}
+			st.dispatchToReceivers(layer.rid, &pkt)
+		}
+	}
+}
+
+// =============================================================================
+// WHIP/WHEP (RFC 9725) - HTTP-based ingest and egress
+// =============================================================================
+
+// parseLinkICEServers extracts ICE servers from Link header values of the
+// form `<stun:example.com>; rel="ice-server"; username="..."; credential="..."`,
+// as WHIP/WHEP clients use to offer their own STUN/TURN servers.
+func parseLinkICEServers(header []string) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+
+	for _, h := range header {
+		for _, part := range strings.Split(h, ",") {
+			part = strings.TrimSpace(part)
+			if !strings.Contains(part, `rel="ice-server"`) {
+				continue
+			}
+
+			start := strings.Index(part, "<")
+			end := strings.Index(part, ">")
+			if start == -1 || end == -1 || end < start {
+				continue
+			}
+
+			servers = append(servers, webrtc.ICEServer{
+				URLs:       []string{part[start+1 : end]},
+				Username:   linkParam(part, "username"),
+				Credential: linkParam(part, "credential"),
+			})
+		}
+	}
+
+	return servers
+}
+
+// linkParam extracts a quoted param=value from one Link header segment, or
+// "" if it isn't present.
+func linkParam(part, name string) string {
+	key := name + `="`
+	idx := strings.Index(part, key)
+	if idx == -1 {
+		return ""
+	}
+	rest := part[idx+len(key):]
+	end := strings.Index(rest, `"`)
+	if end == -1 {
+		return ""
+	}
+	return rest[:end]
+}
+
+// addICEServerLinkHeaders advertises this relay's ICE servers to a
+// WHIP/WHEP client via one Link header per URL, per RFC 9725.
+func addICEServerLinkHeaders(w http.ResponseWriter, servers []webrtc.ICEServer) {
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="ice-server"`, url))
+		}
+	}
+}
+
+// splitResourcePath splits a WHIP/WHEP URL of the form {prefix}{stream} or
+// {prefix}{stream}/{resource} into its two parts.
+func splitResourcePath(path, prefix string) (streamID, resourceID string) {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// handleTrickleICE applies an application/trickle-ice-sdpfrag PATCH body -
+// one or more "a=candidate:" lines - to pc, letting WHIP/WHEP clients
+// trickle ICE candidates in after the initial offer/answer instead of
+// gathering everything up front.
+func handleTrickleICE(w http.ResponseWriter, r *http.Request, pc *webrtc.PeerConnection) {
+	if pc == nil {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/trickle-ice-sdpfrag" {
+		http.Error(w, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read sdpfrag", http.StatusBadRequest)
+		return
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+		if err := pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Failed to add trickled ICE candidate: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWHIP implements WHIP (RFC 9725) publishing. POST with an
+// application/sdp offer body creates the named Stream's publisher
+// PeerConnection and returns the SDP answer as a 201 Created, with a
+// Location header identifying the resource for the later DELETE/PATCH.
+// Since each Stream has exactly one publisher, the resource is the stream
+// itself: /whip/{stream}.
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	streamID, resourceID := splitResourcePath(r.URL.Path, "/whip/")
+	if streamID == "" {
+		http.Error(w, "Stream name required", http.StatusBadRequest)
+		return
+	}
+	st := s.stream(streamID)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case http.MethodDelete:
+		st.mu.Lock()
+		if st.senderPC != nil {
+			st.senderPC.Close()
+			st.senderPC = nil
+			st.senderConnected = false
+		}
+		st.mu.Unlock()
+		st.clearLayers()
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case http.MethodPatch:
+		st.mu.Lock()
+		pc := st.senderPC
+		st.mu.Unlock()
+		handleTrickleICE(w, r, pc)
+		return
+
+	case http.MethodPost:
+		// handled below
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if resourceID != "" {
+		http.Error(w, "POST only accepted on the stream URL", http.StatusBadRequest)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/sdp" {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.newPeerConnection("publisher", parseLinkICEServers(r.Header["Link"]))
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	st.mu.Lock()
+	st.senderPC = pc
+	st.senderConnected = true
+	st.mu.Unlock()
+
+	log.Printf("WHIP: publisher PeerConnection created for stream %q", streamID)
+
+	st.wireSenderTrack(pc)
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("WHIP %s: connection state: %s", streamID, state.String())
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			st.mu.Lock()
+			closed := st.senderPC == pc
+			if closed {
+				st.senderPC = nil
+				st.senderConnected = false
+			}
+			st.mu.Unlock()
+			if closed {
+				st.clearLayers()
+			}
+		}
+	})
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+	}
+
+	addICEServerLinkHeaders(w, s.whipWhepICEServers())
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+streamID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("WHIP: publisher live for stream %q", streamID)
+}
+
+// handleWHEP implements WHEP egress. POST with an application/sdp offer
+// body subscribes a new viewer to the named Stream and returns the SDP
+// answer as a 201 Created, with a Location header of
+// /whep/{stream}/{resource} identifying this viewer for the later
+// DELETE/PATCH.
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	streamID, resourceID := splitResourcePath(r.URL.Path, "/whep/")
+	if streamID == "" {
+		http.Error(w, "Stream name required", http.StatusBadRequest)
+		return
+	}
+	st := s.stream(streamID)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case http.MethodDelete:
+		st.removeReceiver(resourceID)
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case http.MethodPatch:
+		st.receiversMu.RLock()
+		receiver := st.receivers[resourceID]
+		st.receiversMu.RUnlock()
+		var pc *webrtc.PeerConnection
+		if receiver != nil {
+			pc = receiver.PC
+		}
+		handleTrickleICE(w, r, pc)
+		return
+
+	case http.MethodPost:
+		// handled below
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if resourceID != "" {
+		http.Error(w, "POST only accepted on the stream URL", http.StatusBadRequest)
+		return
+	}
+
+	st.mu.Lock()
+	senderConnected := st.senderConnected
+	st.mu.Unlock()
+
+	if !senderConnected || !st.hasLayers() {
+		http.Error(w, "Stream not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/sdp" {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.newPeerConnection("viewer", parseLinkICEServers(r.Header["Link"]))
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	receiverID := fmt.Sprintf("whep-%d", time.Now().UnixNano())
+	log.Printf("WHEP: creating receiver %s for stream %q", receiverID, streamID)
+
+	downTrack, err := newH264ForwardingTrack()
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	receiver := &ReceiverClient{
+		ID:        receiverID,
+		PC:        pc,
+		downTrack: downTrack,
+		estimator: NewREMBEstimator(),
+	}
+	if best := st.bestLayer(); best != nil {
+		receiver.currentRID = best.rid
+	}
+	st.wireReceiverDataChannel(pc, receiver)
+
+	st.receiversMu.Lock()
+	st.receivers[receiverID] = receiver
+	st.receiversMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("WHEP %s/%s: connection state: %s", streamID, receiverID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			log.Printf("✓ WHEP %s CONNECTED", receiverID)
+			st.requestKeyframeFromSender()
+		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			st.removeReceiver(receiverID)
+		}
+	})
+
+	rtpSender, err := pc.AddTrack(downTrack)
+	if err != nil {
+		http.Error(w, "Failed to add track", http.StatusInternalServerError)
+		return
+	}
+	go st.handleReceiverRTCP(rtpSender, receiverID)
+	go st.runLayerSelector(receiver)
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+	}
+
+	addICEServerLinkHeaders(w, s.whipWhepICEServers())
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/whep/%s/%s", streamID, receiverID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("WHEP: receiver %s live for stream %q", receiverID, streamID)
+}
+
+// =============================================================================
+// END WHIP/WHEP
+// =============================================================================
+
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	s.receiversMu.RLock()
-	numReceivers := len(s.receivers)
-	s.receiversMu.RUnlock()
+	st := s.stream(defaultStreamID)
+
+	st.receiversMu.RLock()
+	numReceivers := len(st.receivers)
+	st.receiversMu.RUnlock()
+
+	st.mu.Lock()
+	senderConnected := st.senderConnected
+	st.mu.Unlock()
 
 	// =========================================================================
 	// CHANGED: Added latency_supported field to config response
@@ -972,10 +1741,12 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	// NEW: Added latency_supported field
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"sender_url":        s.senderURL,
-		"status":            s.senderConnected,
+		"status":            senderConnected,
 		"num_receivers":     numReceivers,
 		"codec":             "H264",
 		"latency_supported": true, // NEW: Indicates latency measurement is available
+		"receivers":         st.receiverStatsSnapshot(),
+		"ice_servers":       s.whipWhepICEServers(), // NEW: ice.json servers, so browsers don't hard-code STUN/TURN
 	})
 	// =========================================================================
 }
@@ -999,6 +1770,16 @@ func main() {
 	http.HandleFunc("/offer", server.handleOffer)
 	http.HandleFunc("/config", server.handleConfig)
 
+	// WHIP/WHEP: /whip/{stream}[/{resource}] and /whep/{stream}[/{resource}]
+	// let OBS/GStreamer publish and WHEP players subscribe over plain HTTP,
+	// independent of the Python WebSocket sender above.
+	http.HandleFunc("/whip/", server.handleWHIP)
+	http.HandleFunc("/whep/", server.handleWHEP)
+
+	// /record/{stream}/start|stop|list: disk recording of a stream's
+	// forwarded H264 to recordingDir, independent of WHIP/WHEP/WS.
+	http.HandleFunc("/record/", server.handleRecord)
+
 	http.HandleFunc("/client.js", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/javascript")
 		http.ServeFile(w, r, "./static/client.js")
@@ -1029,7 +1810,7 @@ func main() {
 	// =======================================================================
 
 	// =======================================================================
-	// NEW feature list (clarifies DataChannel direction):
+	// NEW feature list (clarifies DataChannel direction, adds WHIP/WHEP):
 	// =======================================================================
 	log.Println("Features:")
 	log.Println("  ✓ H264 video codec")
@@ -1037,10 +1818,16 @@ func main() {
 	log.Println("  ✓ DataChannel created by browser (Go relay ← Browser)")
 	log.Println("  ✓ Timestamps forwarded to browser via DataChannel")
 	log.Println("  ✓ Glass-to-glass latency measurement")
+	log.Println("  ✓ WHIP/WHEP HTTP ingest and egress (multi-stream)")
+	log.Println("  ✓ Simulcast bandwidth-aware layer selection")
+	log.Println("  ✓ Disk recording with segment manifest")
+	log.Println("  ✓ ice.json ICE servers, hot-reloaded on SIGHUP")
 	log.Println(separator)
 	// =======================================================================
 	// =========================================================================
 	log.Printf("WebSocket endpoint: ws://localhost:%d/ws", httpPort)
+	log.Printf("WHIP endpoint: http://localhost:%d/whip/{stream}", httpPort)
+	log.Printf("WHEP endpoint: http://localhost:%d/whep/{stream}", httpPort)
 	log.Printf("Web interface: http://localhost:%d", httpPort)
 	log.Println(separator)
 
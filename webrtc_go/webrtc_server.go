@@ -11,14 +11,32 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
+const defaultStreamID = "default"
+
+// Tunables for the jitter buffer / NACK-PLI feedback loop below.
+const (
+	defaultCacheSize   = 512             // packets held per upstream track
+	defaultNACKRetries = 3               // packets allowed to arrive after a gap's NACK before escalating to PLI
+	defaultPLICooldown = 1 * time.Second // minimum gap between PLIs from gap recovery
+)
+
 type SignalMessage struct {
-	Type      string                    `json:"type"`
-	SDP       string                    `json:"sdp,omitempty"`
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
 	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+
+	// Clock-sync fields, set on type "clock_sync_request"/"clock_sync_response".
+	// ClientTime is t1 (relay send), RecvTime t2 (publisher receive) and
+	// ServerTime t3 (publisher send); runClockSync takes t4 on receipt.
+	ClientTime float64 `json:"client_time,omitempty"`
+	RecvTime   float64 `json:"recv_time,omitempty"`
+	ServerTime float64 `json:"server_time,omitempty"`
 }
 
 type OfferRequest struct {
@@ -26,21 +44,277 @@ type OfferRequest struct {
 	Type string `json:"type"`
 }
 
+// TimestampMessage is sent over a receiver's "control" DataChannel once the
+// clock-sync exchange with the publisher has produced an offset, so the
+// browser can convert a publisher-stamped capture_ms into the relay's clock
+// domain (relay_ms = capture_ms - offset_ms, offset_ms being publisher clock
+// minus relay clock) without running its own NTP round.
+type TimestampMessage struct {
+	Type       string  `json:"type"`
+	ServerTime float64 `json:"server_time"`
+	OffsetMs   float64 `json:"offset_ms"`
+	RTTMs      float64 `json:"rtt_ms"`
+}
+
+// WHIPSession tracks a WHIP (ingest) or WHEP (playback) resource so that
+// PATCH (trickle ICE) and DELETE (teardown) can find the PeerConnection
+// they apply to. The resource ID is handed back to the client in the
+// Location header of the initial POST response.
+type WHIPSession struct {
+	ID       string
+	StreamID string
+	PC       *webrtc.PeerConnection
+}
+
+// Publisher is one named upstream stream, published by a single Python
+// sender (or WHIP ingester). Server used to hold a single senderPC and
+// videoTrack; now every publish under a distinct stream ID gets its own.
+type Publisher struct {
+	ID         string
+	StreamID   string
+	PC         *webrtc.PeerConnection
+	VideoTrack *webrtc.TrackLocalStaticRTP
+	AudioTrack *webrtc.TrackLocalStaticRTP
+	Connected  bool
+	mu         sync.Mutex
+
+	// Layers holds one outgoing track per simulcast RID when the sender
+	// publishes simulcast, each fed only by its own RID's packets.
+	// VideoTrack is the "f" layer's track once that layer arrives, otherwise
+	// the first layer to arrive, so non-simulcast-aware code paths keep
+	// working unchanged.
+	Layers map[string]*webrtc.TrackLocalStaticRTP
+
+	// Cache holds recently forwarded packets so a downstream NACK can be
+	// served without round-tripping to the Python sender. Jitter tracks
+	// inter-arrival variance on the up-track (RFC 3550 §6.4.1 style).
+	Cache  *packetCache
+	Jitter *jitterEstimator
+
+	seqMu       sync.Mutex
+	haveSeq     bool
+	expectedSeq uint16
+	missing     map[uint16]int // seq -> packets arrived since it was NACKed
+	lastPLI     time.Time
+
+	// Clock sync against the publisher's own clock (see runClockSync).
+	// ClockRTTMs tracks the minimum round-trip observed so far, so a later,
+	// noisier sample never overwrites a better offset estimate.
+	clockMu       sync.Mutex
+	ClockOffsetMs float64
+	ClockRTTMs    float64
+	syncPending   chan SignalMessage
+
+	// CaptureExtID is the negotiated numeric ID of the abs-capture-time RTP
+	// header extension on the up-track, or 0 if the publisher didn't
+	// negotiate it. Non-zero means browsers get frame-accurate capture
+	// timestamps straight off the packet, so runClockSync's periodic drift
+	// tracking (the DataChannel fallback) can stop once it's set.
+	CaptureExtID   uint8
+	LastCaptureNTP uint64
+}
+
+// packetCache is a ring buffer of the last N RTP packets on an upstream
+// track, keyed by sequence number, so a NACK from a downstream receiver can
+// be served locally instead of waiting for the Python sender to resend.
+type packetCache struct {
+	mu      sync.Mutex
+	packets []*rtp.Packet
+	seqs    []uint16
+	valid   []bool
+}
+
+func newPacketCache(size int) *packetCache {
+	return &packetCache{
+		packets: make([]*rtp.Packet, size),
+		seqs:    make([]uint16, size),
+		valid:   make([]bool, size),
+	}
+}
+
+func (c *packetCache) Store(pkt *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := int(pkt.SequenceNumber) % len(c.packets)
+	c.packets[idx] = pkt
+	c.seqs[idx] = pkt.SequenceNumber
+	c.valid[idx] = true
+}
+
+func (c *packetCache) Get(seq uint16) (*rtp.Packet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := int(seq) % len(c.packets)
+	if !c.valid[idx] || c.seqs[idx] != seq {
+		return nil, false
+	}
+	return c.packets[idx], true
+}
+
+// jitterEstimator tracks inter-arrival jitter using the RFC 3550 §6.4.1
+// running estimate: J += (|D| - J) / 16, where D is the difference in
+// relative transit time between two packets.
+type jitterEstimator struct {
+	mu            sync.Mutex
+	clockRate     float64
+	haveLast      bool
+	lastTransit   float64
+	lastArrival   time.Time
+	lastTimestamp uint32
+	jitter        float64
+}
+
+func newJitterEstimator(clockRate uint32) *jitterEstimator {
+	return &jitterEstimator{clockRate: float64(clockRate)}
+}
+
+// Update feeds one packet's RTP timestamp and wall-clock arrival time into
+// the estimator and returns the current jitter estimate in milliseconds.
+func (j *jitterEstimator) Update(rtpTimestamp uint32, arrival time.Time) float64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	arrivalUnits := arrival.Sub(time.Unix(0, 0)).Seconds() * j.clockRate
+	transit := arrivalUnits - float64(rtpTimestamp)
+
+	if j.haveLast {
+		d := transit - j.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		j.jitter += (d - j.jitter) / 16
+	}
+
+	j.lastTransit = transit
+	j.lastArrival = arrival
+	j.lastTimestamp = rtpTimestamp
+	j.haveLast = true
+
+	return (j.jitter / j.clockRate) * 1000
+}
+
+// ReceiverClient is one subscriber's PeerConnection for a given stream. A
+// control DataChannel is opened on it so the server can push a
+// renegotiation notice if its publisher goes away mid-session.
+type ReceiverClient struct {
+	ID        string
+	StreamID  string
+	PC        *webrtc.PeerConnection
+	RTPSender *webrtc.RTPSender
+	Control   *webrtc.DataChannel
+
+	// Estimator tracks this receiver's available downlink bandwidth from
+	// REMB feedback, driving simulcast layer selection below.
+	Estimator *bitrateEstimator
+
+	layerMu      sync.Mutex
+	currentLayer string
+}
+
+// bitrateEstimator is a minimal galene-style `sfu/estimator.Estimator`: it
+// keeps the most recent REMB value the browser reported along with a
+// measured send rate, and that's the estimate simulcast layer selection
+// acts on. A full Transport-CC implementation would derive the estimate
+// from per-packet feedback instead of trusting REMB outright.
+type bitrateEstimator struct {
+	mu          sync.Mutex
+	rembBps     uint64
+	sentBytes   uint64
+	windowStart time.Time
+	measuredBps uint64
+}
+
+func newBitrateEstimator() *bitrateEstimator {
+	return &bitrateEstimator{windowStart: time.Now()}
+}
+
+// OnREMB records a browser-reported REMB ceiling.
+func (b *bitrateEstimator) OnREMB(bps uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rembBps = bps
+}
+
+// OnPacketSent feeds the estimator's own throughput measurement, folding
+// over a 1s window.
+func (b *bitrateEstimator) OnPacketSent(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sentBytes += uint64(n)
+	if elapsed := time.Since(b.windowStart); elapsed >= time.Second {
+		b.measuredBps = uint64(float64(b.sentBytes*8) / elapsed.Seconds())
+		b.sentBytes = 0
+		b.windowStart = time.Now()
+	}
+}
+
+// Estimate returns the current usable bitrate: the smaller of the
+// browser's REMB ceiling and our own measured send rate, or whichever of
+// the two is non-zero. Nothing in the relay calls OnPacketSent, so the
+// measured rate stays 0 and the estimate is the latest REMB value.
+func (b *bitrateEstimator) Estimate() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.rembBps == 0:
+		return b.measuredBps
+	case b.measuredBps == 0:
+		return b.rembBps
+	case b.rembBps < b.measuredBps:
+		return b.rembBps
+	default:
+		return b.measuredBps
+	}
+}
+
+// simulcastLayer is one named encoding (RID) of a simulcast publish, along
+// with the minimum bitrate a receiver needs before it's a candidate layer.
+type simulcastLayer struct {
+	rid    string
+	minBps uint64
+}
+
+// simulcastLadder is ordered high to low quality. Forwarding layer choice
+// walks it from the first entry looking for the highest layer the estimate
+// can afford.
+var simulcastLadder = []simulcastLayer{
+	{rid: "f", minBps: 1_200_000}, // full
+	{rid: "h", minBps: 500_000},   // half
+	{rid: "q", minBps: 0},         // quarter, always affordable
+}
+
+// chooseLayer picks the best affordable RID for a given bitrate estimate
+// out of the layers the publisher actually has tracks for.
+func chooseLayer(estimateBps uint64, available map[string]*webrtc.TrackLocalStaticRTP) string {
+	for _, layer := range simulcastLadder {
+		if _, ok := available[layer.rid]; ok && estimateBps >= layer.minBps {
+			return layer.rid
+		}
+	}
+	return ""
+}
+
 // Server manages WebRTC connections and signaling
 type Server struct {
 	upgrader websocket.Upgrader
 
-	// Peer connections
-	senderPC    *webrtc.PeerConnection
-	receivers   map[string]*webrtc.PeerConnection
+	// Publishers, keyed by stream ID. Each stream is published by at most
+	// one upstream sender at a time.
+	publishers   map[string]*Publisher
+	publishersMu sync.RWMutex
+
+	// Subscribers, keyed by stream ID.
+	receivers   map[string][]*ReceiverClient
 	receiversMu sync.RWMutex
 
-	// Tracks
-	videoTrack *webrtc.TrackLocalStaticRTP
+	// WHIP/WHEP resources, keyed by the resource ID returned in Location.
+	sessions   map[string]*WHIPSession
+	sessionsMu sync.RWMutex
 
-	// Synchronization
-	mu              sync.Mutex
-	senderConnected bool
+	// Jitter buffer / NACK-PLI knobs, defaulted in NewServer.
+	CacheSize   int
+	NACKRetries int
+	PLICooldown time.Duration
 
 	// Configuration
 	senderURL string
@@ -53,13 +327,175 @@ func NewServer(senderURL string) *Server {
 				return true
 			},
 		},
-		receivers: make(map[string]*webrtc.PeerConnection),
-		senderURL: senderURL,
+		publishers:  make(map[string]*Publisher),
+		receivers:   make(map[string][]*ReceiverClient),
+		sessions:    make(map[string]*WHIPSession),
+		CacheSize:   defaultCacheSize,
+		NACKRetries: defaultNACKRetries,
+		PLICooldown: defaultPLICooldown,
+		senderURL:   senderURL,
+	}
+}
+
+func peerConnectionConfig() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+			{URLs: []string{"stun:stun1.l.google.com:19302"}},
+		},
+	}
+}
+
+// absCaptureTimeURI is the RTP header extension carrying the sender's
+// capture timestamp on each packet, so browsers get frame-accurate timing
+// without a separate clock-sync round trip. See runClockSync/TimestampMessage
+// for the DataChannel-based fallback used when a peer doesn't negotiate it.
+const absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+// sharedAPI is built once with abs-capture-time registered on both media
+// kinds, so every PeerConnection the relay creates offers/accepts it the
+// same way a plain webrtc.NewPeerConnection would for everything else.
+var sharedAPI = newWebRTCAPI()
+
+func newWebRTCAPI() *webrtc.API {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		log.Fatalf("Failed to register default codecs: %v", err)
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: absCaptureTimeURI}, kind); err != nil {
+			log.Printf("Failed to register abs-capture-time extension for %s: %v", kind, err)
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		log.Fatalf("Failed to register default interceptors: %v", err)
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+}
+
+// newPeerConnection creates a PeerConnection through sharedAPI instead of
+// the package-level default, so abs-capture-time gets negotiated.
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	return sharedAPI.NewPeerConnection(peerConnectionConfig())
+}
+
+// headerExtensionID looks up the numeric ID a receiver's SDP negotiation
+// assigned a header extension URI, or 0 if it wasn't negotiated.
+func headerExtensionID(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// decodeAbsCaptureTime parses the fixed 8-byte form of abs-capture-time: a
+// Q32.32 NTP-style timestamp marking when the sender captured the frame.
+// The optional 8-byte estimated-capture-clock-offset extension, if present,
+// is ignored.
+func decodeAbsCaptureTime(ext []byte) (captureNTP uint64, ok bool) {
+	if len(ext) < 8 {
+		return 0, false
+	}
+	return uint64(ext[0])<<56 | uint64(ext[1])<<48 | uint64(ext[2])<<40 | uint64(ext[3])<<32 |
+		uint64(ext[4])<<24 | uint64(ext[5])<<16 | uint64(ext[6])<<8 | uint64(ext[7]), true
+}
+
+// streamFromPath extracts the stream ID following the given prefix, e.g.
+// streamFromPath("/publish/cam1", "/publish/") == "cam1". Falls back to
+// defaultStreamID when nothing follows the prefix.
+func streamFromPath(path, prefix string) string {
+	streamID := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if streamID == "" {
+		return defaultStreamID
+	}
+	return streamID
+}
+
+// getOrCreatePublisher returns the Publisher for streamID, creating an
+// empty placeholder if this is the first time the stream is seen.
+func (s *Server) getOrCreatePublisher(streamID string) *Publisher {
+	s.publishersMu.Lock()
+	defer s.publishersMu.Unlock()
+
+	if p, ok := s.publishers[streamID]; ok {
+		return p
+	}
+	p := &Publisher{ID: fmt.Sprintf("pub-%s-%d", streamID, time.Now().UnixNano()), StreamID: streamID}
+	s.publishers[streamID] = p
+	return p
+}
+
+func (s *Server) getPublisher(streamID string) (*Publisher, bool) {
+	s.publishersMu.RLock()
+	defer s.publishersMu.RUnlock()
+	p, ok := s.publishers[streamID]
+	return p, ok
+}
+
+func (s *Server) addReceiver(streamID string, rc *ReceiverClient) {
+	s.receiversMu.Lock()
+	defer s.receiversMu.Unlock()
+	s.receivers[streamID] = append(s.receivers[streamID], rc)
+}
+
+func (s *Server) removeReceiver(streamID, receiverID string) {
+	s.receiversMu.Lock()
+	defer s.receiversMu.Unlock()
+	list := s.receivers[streamID]
+	for i, rc := range list {
+		if rc.ID == receiverID {
+			s.receivers[streamID] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Server) receiversFor(streamID string) []*ReceiverClient {
+	s.receiversMu.RLock()
+	defer s.receiversMu.RUnlock()
+	out := make([]*ReceiverClient, len(s.receivers[streamID]))
+	copy(out, s.receivers[streamID])
+	return out
+}
+
+// teardownPublisher runs when a stream's upstream sender disconnects: it
+// pulls the publisher's track off every subscriber's PeerConnection and
+// pushes a renegotiation notice over each subscriber's control channel so
+// the browser knows to either resubscribe or tear down its own UI.
+func (s *Server) teardownPublisher(streamID string) {
+	s.publishersMu.Lock()
+	delete(s.publishers, streamID)
+	s.publishersMu.Unlock()
+
+	for _, rc := range s.receiversFor(streamID) {
+		if rc.RTPSender != nil {
+			if err := rc.PC.RemoveTrack(rc.RTPSender); err != nil {
+				log.Printf("Failed to remove track from receiver %s: %v", rc.ID, err)
+			}
+		}
+		if rc.Control != nil && rc.Control.ReadyState() == webrtc.DataChannelStateOpen {
+			notice, _ := json.Marshal(map[string]string{"type": "renegotiate", "reason": "publisher_gone", "stream": streamID})
+			if err := rc.Control.SendText(string(notice)); err != nil {
+				log.Printf("Failed to notify receiver %s of teardown: %v", rc.ID, err)
+			}
+		}
 	}
+
+	log.Printf("Publisher for stream %q torn down, %d subscriber(s) notified", streamID, len(s.receiversFor(streamID)))
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	log.Println("New WebSocket connection from Python sender")
+	streamID := r.URL.Query().Get("stream")
+	if streamID == "" {
+		streamID = defaultStreamID
+	}
+
+	log.Printf("New WebSocket connection from Python sender (stream=%s)", streamID)
 
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -67,7 +503,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
-	
+
 	// Configure WebSocket with longer read deadline
 	conn.SetReadDeadline(time.Now().Add(120 * time.Second))
 	conn.SetPongHandler(func(string) error {
@@ -78,7 +514,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Start ping ticker for keepalive from server side
 	pingTicker := time.NewTicker(30 * time.Second)
 	defer pingTicker.Stop()
-	
+
 	go func() {
 		for range pingTicker.C {
 			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -89,156 +525,25 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("WebSocket connection established with sender")
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"stun:stun1.l.google.com:19302"}},
-		},
-	}
-
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := newPeerConnection()
 	if err != nil {
 		log.Println("Failed to create PeerConnection:", err)
 		return
 	}
 	defer pc.Close()
 
-	s.mu.Lock()
-	s.senderPC = pc
-	s.senderConnected = true
-	s.mu.Unlock()
-
-	log.Println("Sender PeerConnection created")
-
-	// Variable to track if we've seen a keyframe
-	hasKeyframe := false
-	keyframeMutex := &sync.Mutex{}
-
-	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Received track from sender - Kind: %s, Codec: %s, PT: %d", 
-			track.Kind(), track.Codec().MimeType, track.PayloadType())
-
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			log.Println("Creating local video track for forwarding...")
-
-			localTrack, err := webrtc.NewTrackLocalStaticRTP(
-				webrtc.RTPCodecCapability{
-					MimeType:    webrtc.MimeTypeVP8,
-					ClockRate:   90000,
-					SDPFmtpLine: "",
-				},
-				"video",
-				"stream",
-			)
-			if err != nil {
-				log.Println("Failed to create local track:", err)
-				return
-			}
-
-			s.mu.Lock()
-			s.videoTrack = localTrack
-			s.mu.Unlock()
+	publisher := s.getOrCreatePublisher(streamID)
+	publisher.mu.Lock()
+	publisher.PC = pc
+	publisher.Connected = true
+	publisher.mu.Unlock()
 
-			log.Println("Local video track created for VP8")
+	log.Printf("Sender PeerConnection created for stream %q", streamID)
 
-			// Add track to all existing receivers
-			s.receiversMu.RLock()
-			for id, receiverPC := range s.receivers {
-				if receiverPC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-					_, err := receiverPC.AddTrack(localTrack)
-					if err != nil {
-						log.Printf("Failed to add track to receiver %s: %v", id, err)
-					}
-				}
-			}
-			s.receiversMu.RUnlock()
-
-			// Request initial keyframe
-			go func() {
-				time.Sleep(1 * time.Second)
-				if err := pc.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: uint32(track.SSRC()),
-					},
-				}); err != nil {
-					log.Printf("Failed to request initial keyframe: %v", err)
-				} else {
-					log.Println("Initial keyframe request sent")
-				}
-			}()
-
-			// Periodic keyframe requests
-			go func() {
-				ticker := time.NewTicker(5 * time.Second)
-				defer ticker.Stop()
-				
-				for range ticker.C {
-					keyframeMutex.Lock()
-					needsKeyframe := !hasKeyframe
-					keyframeMutex.Unlock()
-					
-					if needsKeyframe && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
-						if err := pc.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{
-								MediaSSRC: uint32(track.SSRC()),
-							},
-						}); err != nil {
-							log.Printf("Failed to send PLI: %v", err)
-						} else {
-							log.Println("Periodic keyframe request sent")
-						}
-					}
-				}
-			}()
-
-			// Forward packets
-			go func() {
-				packetCount := 0
-				
-				for {
-					rtpPacket, _, readErr := track.ReadRTP()
-					if readErr != nil {
-						if readErr != io.EOF {
-							log.Printf("Error reading RTP: %v", readErr)
-						}
-						return
-					}
-
-					packetCount++
-
-					// Check for VP8 keyframe
-					if len(rtpPacket.Payload) > 0 {
-						vp8Header := rtpPacket.Payload[0]
-						isKeyframe := (vp8Header & 0x01) == 0
-						
-						if isKeyframe {
-							keyframeMutex.Lock()
-							if !hasKeyframe {
-								log.Printf("First keyframe received at packet #%d!", packetCount)
-								hasKeyframe = true
-							}
-							keyframeMutex.Unlock()
-						}
-					}
+	s.attachPublisherTrackHandler(publisher, pc)
 
-					if packetCount%500 == 0 {
-						log.Printf("Forwarded %d packets", packetCount)
-					}
-
-					// Write RTP packet
-					s.mu.Lock()
-					if s.videoTrack != nil {
-						if err := s.videoTrack.WriteRTP(rtpPacket); err != nil && err != io.ErrClosedPipe {
-							if packetCount%100 == 0 {
-								log.Printf("Error writing RTP: %v", err)
-							}
-						}
-					}
-					s.mu.Unlock()
-				}
-			}()
-		}
-	})
+	publisher.syncPending = make(chan SignalMessage, 1)
+	go s.runClockSync(conn, publisher)
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil {
@@ -259,7 +564,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	})
 
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("Sender connection state: %s", state.String())
+		log.Printf("Sender connection state (stream=%s): %s", streamID, state.String())
 
 		if state == webrtc.PeerConnectionStateConnected {
 			log.Println("SENDER CONNECTED - Ready to receive video!")
@@ -275,10 +580,10 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Handle signaling messages with ping/pong support
 	for {
 		var msg SignalMessage
-		
+
 		// Reset read deadline for each message
 		conn.SetReadDeadline(time.Now().Add(120 * time.Second))
-		
+
 		err := conn.ReadJSON(&msg)
 		if err != nil {
 			log.Printf("WebSocket disconnected: %v", err)
@@ -335,7 +640,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 					log.Println("Sender ICE candidate added")
 				}
 			}
-		
+
 		// WICHTIGG!!!! NEW: Handle ping messages
 		case "ping":
 			// Respond with pong to keep connection alive
@@ -344,15 +649,21 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			if err := conn.WriteJSON(pong); err != nil {
 				log.Printf("Failed to send pong: %v", err)
 			}
+
+		case "clock_sync_response":
+			select {
+			case publisher.syncPending <- msg:
+			default:
+				// No sample currently waiting on a reply; drop it.
+			}
 		}
 	}
 
 	// Cleanup
-	s.mu.Lock()
-	s.senderConnected = false
-	s.senderPC = nil
-	s.videoTrack = nil
-	s.mu.Unlock()
+	publisher.mu.Lock()
+	publisher.Connected = false
+	publisher.mu.Unlock()
+	s.teardownPublisher(streamID)
 
 	log.Println("Sender disconnected")
 }
@@ -375,12 +686,13 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.mu.Lock()
-	senderConnected := s.senderConnected
-	videoTrack := s.videoTrack
-	s.mu.Unlock()
+	streamID := r.URL.Query().Get("stream")
+	if streamID == "" {
+		streamID = defaultStreamID
+	}
 
-	if !senderConnected || videoTrack == nil {
+	publisher, ok := s.getPublisher(streamID)
+	if !ok || !publisher.Connected || publisher.VideoTrack == nil {
 		log.Println("Sender not connected or video track not ready")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -399,14 +711,7 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("Parsed browser offer")
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"stun:stun1.l.google.com:19302"}},
-		},
-	}
-
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := newPeerConnection()
 	if err != nil {
 		log.Printf("Failed to create receiver PeerConnection: %v", err)
 		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
@@ -414,12 +719,10 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	receiverID := fmt.Sprintf("receiver-%d", time.Now().UnixNano())
+	rc := &ReceiverClient{ID: receiverID, StreamID: streamID, PC: pc}
+	s.addReceiver(streamID, rc)
 
-	s.receiversMu.Lock()
-	s.receivers[receiverID] = pc
-	s.receiversMu.Unlock()
-
-	log.Printf("Receiver PeerConnection created (ID: %s)", receiverID)
+	log.Printf("Receiver PeerConnection created (ID: %s, stream: %s)", receiverID, streamID)
 
 	// Monitor connection
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
@@ -427,12 +730,12 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 
 		if state == webrtc.PeerConnectionStateConnected {
 			log.Printf("BROWSER %s CONNECTED!", receiverID)
-			
+
 			// Request keyframe for new connection
-			if s.senderPC != nil {
-				for _, receiver := range s.senderPC.GetReceivers() {
+			if p, ok := s.getPublisher(streamID); ok && p.PC != nil {
+				for _, receiver := range p.PC.GetReceivers() {
 					if receiver.Track() != nil && receiver.Track().Kind() == webrtc.RTPCodecTypeVideo {
-						s.senderPC.WriteRTCP([]rtcp.Packet{
+						p.PC.WriteRTCP([]rtcp.Packet{
 							&rtcp.PictureLossIndication{
 								MediaSSRC: uint32(receiver.Track().SSRC()),
 							},
@@ -444,10 +747,7 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 			}
 		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
 			log.Printf("Receiver %s disconnected", receiverID)
-			
-			s.receiversMu.Lock()
-			delete(s.receivers, receiverID)
-			s.receiversMu.Unlock()
+			s.removeReceiver(streamID, receiverID)
 		}
 	})
 
@@ -455,23 +755,49 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Receiver %s ICE state: %s", receiverID, state.String())
 	})
 
-	// Add the video track
-	rtpSender, err := pc.AddTrack(videoTrack)
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == "control" {
+			rc.Control = dc
+		}
+	})
+
+	// Add the video track, starting at whatever simulcast layer the
+	// receiver's (still cold) bandwidth estimate affords.
+	rc.Estimator = newBitrateEstimator()
+	initialTrack := s.selectLayerForReceiver(publisher, rc)
+	if initialTrack == nil {
+		initialTrack = publisher.VideoTrack
+	}
+	rtpSender, err := pc.AddTrack(initialTrack)
 	if err != nil {
 		log.Printf("Failed to add track: %v", err)
 		http.Error(w, "Failed to add track", http.StatusInternalServerError)
 		return
 	}
-	
+	rc.RTPSender = rtpSender
+
 	log.Printf("Video track added to receiver")
 
-	// Handle RTCP
+	publisher.mu.Lock()
+	audioTrack := publisher.AudioTrack
+	publisher.mu.Unlock()
+	if audioTrack != nil {
+		if _, err := pc.AddTrack(audioTrack); err != nil {
+			log.Printf("Failed to add audio track: %v", err)
+		}
+	}
+
+	// Handle RTCP: serve NACKs from the publisher's packet cache instead of
+	// just draining the buffer.
 	go func() {
 		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			n, _, rtcpErr := rtpSender.Read(rtcpBuf)
+			if rtcpErr != nil {
 				return
 			}
+			s.serveNACKsFromCache(publisher, rc, rtcpBuf[:n])
+			s.handleReceiverFeedback(publisher, rc, rtcpBuf[:n])
 		}
 	}()
 
@@ -525,69 +851,1070 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	log.Println("Answer sent to browser")
 }
 
-func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	
-	s.receiversMu.RLock()
-	numReceivers := len(s.receivers)
-	s.receiversMu.RUnlock()
-	
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"sender_url":    s.senderURL,
-		"status":        s.senderConnected,
-		"num_receivers": numReceivers,
-	})
+// handleWHIP implements the ingest side of WHIP (WebRTC-HTTP Ingestion
+// Protocol) for the default (unnamed) stream: a POST of an
+// `application/sdp` offer creates the sender PeerConnection and returns the
+// answer SDP along with a Location header pointing at the new resource, so
+// OBS/GStreamer-style WHIP clients can publish without going through the
+// Python sender's WebSocket handshake. Named streams go through /publish.
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	s.handlePublish(w, r, defaultStreamID)
 }
 
-func main() {
-	httpPort := 8080
-	senderURL := "Python Sender via WebSocket"
+// handleWHEP mirrors handleWHIP for the default stream's subscribers.
+// Named streams go through /subscribe.
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	s.handleSubscribe(w, r, defaultStreamID)
+}
 
-	server := NewServer(senderURL)
+// handlePublishPath routes /publish/{stream} to handlePublish.
+func (s *Server) handlePublishPath(w http.ResponseWriter, r *http.Request) {
+	s.handlePublish(w, r, streamFromPath(r.URL.Path, "/publish/"))
+}
 
-	// Serve static files
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			http.ServeFile(w, r, "./static/index.html")
-			return
-		}
-		fs := http.FileServer(http.Dir("./static"))
-		fs.ServeHTTP(w, r)
-	})
+// handleSubscribePath routes /subscribe/{stream} to handleSubscribe.
+func (s *Server) handleSubscribePath(w http.ResponseWriter, r *http.Request) {
+	s.handleSubscribe(w, r, streamFromPath(r.URL.Path, "/subscribe/"))
+}
 
-	http.HandleFunc("/ws", server.handleWebSocket)
-	http.HandleFunc("/offer", server.handleOffer)
-	http.HandleFunc("/config", server.handleConfig)
-	
-	http.HandleFunc("/client.js", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/javascript")
-		http.ServeFile(w, r, "./static/client.js")
-	})
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, streamID string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("WebRTC Server Running"))
-	})
+		return
+	}
 
-	separator := strings.Repeat("=", 60)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	log.Println(separator)
-	log.Println("WebRTC Server with Keepalive Starting...")
-	log.Println(separator)
-	log.Printf("WebSocket endpoint: ws://localhost:%d/ws", httpPort)
-	log.Printf("Web interface: http://localhost:%d", httpPort)
-	log.Println(separator)
-	log.Println("Instructions:")
-	log.Println("   1. Start this server")
-	log.Println("   2. Start Python sender")
-	log.Println("   3. Wait for 'SENDER CONNECTED' message")
-	log.Println("   4. Open browser at http://localhost:8080")
-	log.Println("   5. Click 'Start Stream'")
-	log.Println(separator)
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
 
-	addr := fmt.Sprintf(":%d", httpPort)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal("!! Server failed to start:", err)
+	offerSDP, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer body", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := newPeerConnection()
+	if err != nil {
+		log.Printf("WHIP: failed to create PeerConnection: %v", err)
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	publisher := s.getOrCreatePublisher(streamID)
+	publisher.mu.Lock()
+	publisher.PC = pc
+	publisher.Connected = true
+	publisher.mu.Unlock()
+
+	s.attachPublisherTrackHandler(publisher, pc)
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offerSDP),
+	}); err != nil {
+		log.Printf("WHIP: failed to set remote description: %v", err)
+		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("WHIP: failed to create answer: %v", err)
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
 	}
-}
\ No newline at end of file
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("WHIP: failed to set local description: %v", err)
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+		log.Println("WHIP: ICE gathering timeout")
+	}
+
+	resourceID := fmt.Sprintf("whip-%s-%d", streamID, time.Now().UnixNano())
+	s.sessionsMu.Lock()
+	s.sessions[resourceID] = &WHIPSession{ID: resourceID, StreamID: streamID, PC: pc}
+	s.sessionsMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.teardownSession(resourceID)
+			s.teardownPublisher(streamID)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("WHIP: publisher connected (stream %q, resource %s)", streamID, resourceID)
+}
+
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request, streamID string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	publisher, ok := s.getPublisher(streamID)
+	if !ok || !publisher.Connected || publisher.VideoTrack == nil {
+		http.Error(w, fmt.Sprintf("Stream %q not ready", streamID), http.StatusServiceUnavailable)
+		return
+	}
+
+	offerSDP, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer body", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := newPeerConnection()
+	if err != nil {
+		log.Printf("WHEP: failed to create PeerConnection: %v", err)
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	receiverID := fmt.Sprintf("whep-%d", time.Now().UnixNano())
+	rc := &ReceiverClient{ID: receiverID, StreamID: streamID, PC: pc}
+	s.addReceiver(streamID, rc)
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == "control" {
+			rc.Control = dc
+		}
+	})
+
+	rc.Estimator = newBitrateEstimator()
+	initialTrack := s.selectLayerForReceiver(publisher, rc)
+	if initialTrack == nil {
+		initialTrack = publisher.VideoTrack
+	}
+	rtpSender, err := pc.AddTrack(initialTrack)
+	if err != nil {
+		log.Printf("WHEP: failed to add track: %v", err)
+		http.Error(w, "Failed to add track", http.StatusInternalServerError)
+		return
+	}
+	rc.RTPSender = rtpSender
+
+	publisher.mu.Lock()
+	audioTrack := publisher.AudioTrack
+	publisher.mu.Unlock()
+	if audioTrack != nil {
+		if _, err := pc.AddTrack(audioTrack); err != nil {
+			log.Printf("WHEP: failed to add audio track: %v", err)
+		}
+	}
+
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			n, _, rtcpErr := rtpSender.Read(rtcpBuf)
+			if rtcpErr != nil {
+				return
+			}
+			s.serveNACKsFromCache(publisher, rc, rtcpBuf[:n])
+			s.handleReceiverFeedback(publisher, rc, rtcpBuf[:n])
+		}
+	}()
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offerSDP),
+	}); err != nil {
+		log.Printf("WHEP: failed to set remote description: %v", err)
+		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("WHEP: failed to create answer: %v", err)
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("WHEP: failed to set local description: %v", err)
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+		log.Println("WHEP: ICE gathering timeout")
+	}
+
+	resourceID := fmt.Sprintf("whep-%s-%d", streamID, time.Now().UnixNano())
+	s.sessionsMu.Lock()
+	s.sessions[resourceID] = &WHIPSession{ID: resourceID, StreamID: streamID, PC: pc}
+	s.sessionsMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("WHEP receiver %s (stream %s) state: %s", receiverID, streamID, state.String())
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.removeReceiver(streamID, receiverID)
+			s.teardownSession(resourceID)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("WHEP: subscriber connected (stream %q, resource %s)", streamID, resourceID)
+}
+
+// handleWHIPResource services PATCH (trickle ICE via SDP fragment) and
+// DELETE (teardown) against a resource previously created by handleWHIP
+// or handleWHEP.
+func (s *Server) handleWHIPResource(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "PATCH, DELETE, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resourceID := strings.TrimPrefix(r.URL.Path, "/whip/")
+	resourceID = strings.TrimPrefix(resourceID, "/whep/")
+
+	s.sessionsMu.RLock()
+	session, ok := s.sessions[resourceID]
+	s.sessionsMu.RUnlock()
+
+	if !ok {
+		http.Error(w, "Unknown resource", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		session.PC.Close()
+		s.teardownSession(resourceID)
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/trickle-ice-sdpfrag") {
+			http.Error(w, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		fragment, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read SDP fragment", http.StatusBadRequest)
+			return
+		}
+
+		candidate, ufrag := parseICEFragment(string(fragment))
+		if candidate == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := session.PC.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:        candidate,
+			UsernameFragment: &ufrag,
+		}); err != nil {
+			log.Printf("WHIP/WHEP: failed to add trickled candidate for %s: %v", resourceID, err)
+			http.Error(w, "Failed to add ICE candidate", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseICEFragment pulls the first a=candidate line and ice-ufrag out of a
+// minimal SDP fragment as sent by WHIP/WHEP PATCH requests for trickle ICE.
+func parseICEFragment(fragment string) (candidate, ufrag string) {
+	for _, line := range strings.Split(fragment, "\r\n") {
+		switch {
+		case strings.HasPrefix(line, "a=candidate:"):
+			if candidate == "" {
+				candidate = strings.TrimPrefix(line, "a=")
+			}
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return candidate, ufrag
+}
+
+func (s *Server) teardownSession(resourceID string) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, resourceID)
+	s.sessionsMu.Unlock()
+}
+
+// codecHandler describes how the relay builds an outgoing track for one
+// negotiated codec and how it recognizes a keyframe in that codec's RTP
+// payload, so attachPublisherTrackHandler doesn't need to hard-code a
+// single video codec.
+type codecHandler struct {
+	capability webrtc.RTPCodecCapability
+	isKeyFrame func(payload []byte) bool // nil for audio codecs
+}
+
+func vp8IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 { // X bit: extended control bits present
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		if ext&0x80 != 0 {
+			offset++ // I: PictureID
+		}
+		if ext&0x40 != 0 {
+			offset++ // L: TL0PICIDX
+		}
+		if ext&0x30 != 0 {
+			offset++ // T/K: TID/KEYIDX
+		}
+		offset++
+	}
+	if len(payload) <= offset {
+		return false
+	}
+	// VP8 payload header P bit: 0 marks a key frame.
+	return payload[offset]&0x01 == 0
+}
+
+func vp9IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// RTP payload descriptor P bit (inter-picture predicted): 0 on a key frame.
+	return payload[0]&0x40 == 0
+}
+
+func av1IsKeyFrame(payload []byte) bool {
+	// A sequence header OBU (type 1) is only ever sent ahead of a key
+	// frame, so its presence in the packet is enough to flag one.
+	for i := 0; i < len(payload); {
+		header := payload[i]
+		obuType := (header >> 3) & 0x0F
+		hasSize := header&0x02 != 0
+		if obuType == 1 {
+			return true
+		}
+		i++
+		if !hasSize || i >= len(payload) {
+			break
+		}
+		size, n := decodeLEB128(payload[i:])
+		if n == 0 {
+			break
+		}
+		i += n + int(size)
+	}
+	return false
+}
+
+func decodeLEB128(b []byte) (value uint64, n int) {
+	for n < len(b) && n < 8 {
+		byt := b[n]
+		value |= uint64(byt&0x7F) << (7 * n)
+		n++
+		if byt&0x80 == 0 {
+			return value, n
+		}
+	}
+	return 0, 0
+}
+
+func h264IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	naluType := payload[0] & 0x1F
+	return naluType == 7 || naluType == 5 // SPS or IDR slice
+}
+
+// codecRegistry maps a negotiated MIME type to how the relay should build
+// the outgoing local track and detect keyframes for it. Mirrors mediamtx's
+// approach of dispatching on the negotiated RTPCodecParameters rather than
+// assuming a single hard-coded codec.
+var codecRegistry = map[string]codecHandler{
+	webrtc.MimeTypeVP8: {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		isKeyFrame: vp8IsKeyFrame,
+	},
+	webrtc.MimeTypeVP9: {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		isKeyFrame: vp9IsKeyFrame,
+	},
+	webrtc.MimeTypeAV1: {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		isKeyFrame: av1IsKeyFrame,
+	},
+	webrtc.MimeTypeH264: {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		isKeyFrame: h264IsKeyFrame,
+	},
+	webrtc.MimeTypeOpus: {
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+	},
+}
+
+// codecHandlerFor looks up the registry by the negotiated MIME type,
+// falling back to VP8 for an unrecognized video codec so a misbehaving
+// sender still gets relayed instead of dropped.
+func codecHandlerFor(mimeType string) codecHandler {
+	if h, ok := codecRegistry[mimeType]; ok {
+		return h
+	}
+	return codecRegistry[webrtc.MimeTypeVP8]
+}
+
+// attachPublisherTrackHandler wires up the OnTrack forwarding behavior
+// shared by the legacy WebSocket sender path, WHIP, and /publish: it
+// builds the outgoing video track and fans incoming RTP out only to
+// receivers subscribed to this publisher's stream.
+func (s *Server) attachPublisherTrackHandler(publisher *Publisher, pc *webrtc.PeerConnection) {
+	hasKeyframe := false
+	keyframeMutex := &sync.Mutex{}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("Stream %q: received track - Kind: %s, Codec: %s, PT: %d, RID: %q",
+			publisher.StreamID, track.Kind(), track.Codec().MimeType, track.PayloadType(), track.RID())
+
+		handler := codecHandlerFor(track.Codec().MimeType)
+		captureTimeExtID := headerExtensionID(receiver, absCaptureTimeURI)
+		publisher.mu.Lock()
+		publisher.CaptureExtID = captureTimeExtID
+		publisher.mu.Unlock()
+
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			s.forwardAudioTrack(publisher, track, handler, captureTimeExtID)
+			return
+		}
+
+		rid := track.RID()
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(handler.capability, "video", publisher.StreamID)
+		if err != nil {
+			log.Println("Failed to create local track:", err)
+			return
+		}
+
+		publisher.mu.Lock()
+		if publisher.Layers == nil {
+			publisher.Layers = make(map[string]*webrtc.TrackLocalStaticRTP)
+		}
+		publisher.Layers[rid] = localTrack
+		// VideoTrack is the top ("f") or only layer, or the first layer to
+		// arrive until one of those does, so callers that don't care about
+		// simulcast keep working unmodified.
+		if rid == "" || rid == simulcastLadder[0].rid || publisher.VideoTrack == nil {
+			publisher.VideoTrack = localTrack
+		}
+		publisher.mu.Unlock()
+
+		publisher.Cache = newPacketCache(s.CacheSize)
+		publisher.Jitter = newJitterEstimator(track.Codec().ClockRate)
+		publisher.seqMu.Lock()
+		publisher.haveSeq = false
+		publisher.missing = make(map[uint16]int)
+		publisher.seqMu.Unlock()
+
+		log.Printf("Stream %q: local video track created for %s (layer %q)", publisher.StreamID, handler.capability.MimeType, rid)
+
+		// Assign each existing subscriber the best layer it can currently
+		// afford (falls back to this track when there's only one layer).
+		for _, rc := range s.receiversFor(publisher.StreamID) {
+			if rc.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+				continue
+			}
+			chosen := s.selectLayerForReceiver(publisher, rc)
+			if chosen == nil {
+				chosen = localTrack
+			}
+			if _, err := rc.PC.AddTrack(chosen); err != nil {
+				log.Printf("Failed to add track to receiver %s: %v", rc.ID, err)
+			}
+		}
+
+		go func() {
+			time.Sleep(1 * time.Second)
+			pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+		}()
+
+		go func() {
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				keyframeMutex.Lock()
+				needsKeyframe := !hasKeyframe
+				keyframeMutex.Unlock()
+				if needsKeyframe && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+					pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+				}
+			}
+		}()
+
+		go func() {
+			packetCount := 0
+			for {
+				rtpPacket, _, readErr := track.ReadRTP()
+				if readErr != nil {
+					if readErr != io.EOF {
+						log.Printf("Stream %q: error reading RTP: %v", publisher.StreamID, readErr)
+					}
+					return
+				}
+				packetCount++
+
+				if len(rtpPacket.Payload) > 0 && handler.isKeyFrame != nil {
+					if handler.isKeyFrame(rtpPacket.Payload) {
+						keyframeMutex.Lock()
+						hasKeyframe = true
+						keyframeMutex.Unlock()
+					}
+				}
+
+				now := time.Now()
+				publisher.Jitter.Update(rtpPacket.Timestamp, now)
+				publisher.Cache.Store(rtpPacket)
+				s.detectUpstreamGaps(publisher, pc, track.SSRC(), rtpPacket.SequenceNumber, now)
+
+				if captureTimeExtID != 0 {
+					if captureNTP, ok := decodeAbsCaptureTime(rtpPacket.GetExtension(captureTimeExtID)); ok {
+						publisher.mu.Lock()
+						publisher.LastCaptureNTP = captureNTP
+						publisher.mu.Unlock()
+					}
+				}
+
+				// rtpPacket still carries its original abs-capture-time
+				// extension (if any), so writing it through unchanged is
+				// enough to hand browsers a frame-accurate capture time —
+				// no DataChannel round trip required. Each layer's packets
+				// go only to that layer's own track.
+				if err := localTrack.WriteRTP(rtpPacket); err != nil && err != io.ErrClosedPipe {
+					log.Printf("Stream %q: error writing RTP: %v", publisher.StreamID, err)
+				}
+			}
+		}()
+	})
+}
+
+// forwardAudioTrack relays an Opus up-track to every current and future
+// subscriber of the stream. Audio has no keyframe concept and isn't put
+// through the video packet cache/NACK machinery, so it's a plain copy loop.
+// captureTimeExtID is unused here beyond documenting intent: Opus packets
+// carry abs-capture-time too when negotiated, and pass through unchanged
+// along with everything else in the packet.
+func (s *Server) forwardAudioTrack(publisher *Publisher, track *webrtc.TrackRemote, handler codecHandler, captureTimeExtID uint8) {
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(handler.capability, "audio", publisher.StreamID)
+	if err != nil {
+		log.Println("Failed to create local audio track:", err)
+		return
+	}
+
+	publisher.mu.Lock()
+	publisher.AudioTrack = localTrack
+	publisher.mu.Unlock()
+
+	log.Printf("Stream %q: local audio track created for %s", publisher.StreamID, handler.capability.MimeType)
+
+	for _, rc := range s.receiversFor(publisher.StreamID) {
+		if rc.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		if _, err := rc.PC.AddTrack(localTrack); err != nil {
+			log.Printf("Failed to add audio track to receiver %s: %v", rc.ID, err)
+		}
+	}
+
+	for {
+		rtpPacket, _, readErr := track.ReadRTP()
+		if readErr != nil {
+			if readErr != io.EOF {
+				log.Printf("Stream %q: error reading audio RTP: %v", publisher.StreamID, readErr)
+			}
+			return
+		}
+		if err := localTrack.WriteRTP(rtpPacket); err != nil && err != io.ErrClosedPipe {
+			log.Printf("Stream %q: error writing audio RTP: %v", publisher.StreamID, err)
+		}
+	}
+}
+
+// nowMillis returns the current wall-clock time in milliseconds, the unit
+// clock-sync timestamps and capture_ms are expressed in throughout.
+func nowMillis() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Millisecond)
+}
+
+// runClockSync runs an NTP-style 4-timestamp exchange against the
+// publisher over its signaling WebSocket: 8 samples right after connect to
+// converge quickly, then one every 30s to track drift. Of all samples seen
+// so far, the one with the lowest RTT is kept as the current offset, since
+// it's the least likely to have been inflated by queuing delay.
+//
+// This is the fallback path: once the up-track negotiates abs-capture-time
+// (publisher.CaptureExtID != 0), browsers get per-packet capture timestamps
+// directly and no longer need the offset this loop broadcasts, so the 30s
+// drift-tracking samples stop. The initial 8 still run regardless, since
+// the track (and therefore CaptureExtID) hasn't necessarily arrived yet
+// when the WebSocket connects.
+func (s *Server) runClockSync(conn *websocket.Conn, publisher *Publisher) {
+	sample := func() bool {
+		t1 := nowMillis()
+		req := SignalMessage{Type: "clock_sync_request", ClientTime: t1}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.WriteJSON(req); err != nil {
+			return false
+		}
+
+		select {
+		case resp := <-publisher.syncPending:
+			if resp.ClientTime != t1 {
+				return true // stale reply for an earlier sample; ignore
+			}
+			t4 := nowMillis()
+			offset := ((resp.RecvTime - t1) + (resp.ServerTime - t4)) / 2
+			rtt := (t4 - t1) - (resp.ServerTime - resp.RecvTime)
+
+			publisher.clockMu.Lock()
+			if publisher.ClockRTTMs == 0 || rtt < publisher.ClockRTTMs {
+				publisher.ClockOffsetMs = offset
+				publisher.ClockRTTMs = rtt
+			}
+			publisher.clockMu.Unlock()
+
+			s.broadcastClockOffset(publisher)
+		case <-time.After(3 * time.Second):
+			// No response in time; try again on the next sample.
+		}
+		return true
+	}
+
+	for i := 0; i < 8; i++ {
+		if !sample() {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		publisher.mu.Lock()
+		negotiated := publisher.CaptureExtID != 0
+		publisher.mu.Unlock()
+		if negotiated {
+			return
+		}
+		if !sample() {
+			return
+		}
+	}
+}
+
+// broadcastClockOffset enriches every connected receiver of a stream with
+// the publisher's current offset/RTT over its "control" DataChannel, if it
+// opened one, so the browser can convert a capture_ms into its own clock
+// domain without running its own sync round.
+func (s *Server) broadcastClockOffset(publisher *Publisher) {
+	publisher.clockMu.Lock()
+	offset := publisher.ClockOffsetMs
+	rtt := publisher.ClockRTTMs
+	publisher.clockMu.Unlock()
+
+	msg := TimestampMessage{
+		Type:       "clock_offset",
+		ServerTime: nowMillis(),
+		OffsetMs:   offset,
+		RTTMs:      rtt,
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	for _, rc := range s.receiversFor(publisher.StreamID) {
+		if rc.Control != nil && rc.Control.ReadyState() == webrtc.DataChannelStateOpen {
+			if err := rc.Control.SendText(string(payload)); err != nil {
+				log.Printf("Receiver %s: failed to send clock offset: %v", rc.ID, err)
+			}
+		}
+	}
+}
+
+// detectUpstreamGaps watches the up-track's sequence numbers for holes. A
+// missing sequence number is NACKed back to the Python sender once, when
+// the gap is found; if it's still missing after s.NACKRetries more packets
+// have arrived, recovery is considered failed and a PLI is sent instead
+// (rate-limited by s.PLICooldown).
+func (s *Server) detectUpstreamGaps(publisher *Publisher, pc *webrtc.PeerConnection, ssrc webrtc.SSRC, seq uint16, now time.Time) {
+	publisher.seqMu.Lock()
+	var gaps []uint16
+	if !publisher.haveSeq {
+		publisher.haveSeq = true
+		publisher.expectedSeq = seq + 1
+	} else if seq == publisher.expectedSeq {
+		publisher.expectedSeq = seq + 1
+	} else if seq16Gt(seq, publisher.expectedSeq) {
+		for missing := publisher.expectedSeq; missing != seq; missing++ {
+			gaps = append(gaps, missing)
+			if _, tracked := publisher.missing[missing]; !tracked {
+				publisher.missing[missing] = 0
+			}
+		}
+		publisher.expectedSeq = seq + 1
+	}
+	delete(publisher.missing, seq)
+
+	// Every packet that arrives while a gap is still outstanding is
+	// another attempt at recovering it, so bump every tracked gap here
+	// rather than only the ones newly found above - otherwise attempts
+	// gets stuck at 1 and the PLI escalation below can never fire.
+	for missing := range publisher.missing {
+		publisher.missing[missing]++
+	}
+
+	var needsPLI bool
+	for seq, attempts := range publisher.missing {
+		if attempts > s.NACKRetries {
+			needsPLI = true
+			delete(publisher.missing, seq)
+		}
+	}
+	canPLI := needsPLI && now.Sub(publisher.lastPLI) > s.PLICooldown
+	if canPLI {
+		publisher.lastPLI = now
+	}
+	publisher.seqMu.Unlock()
+
+	if len(gaps) > 0 {
+		if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+			MediaSSRC: uint32(ssrc),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(gaps),
+		}}); err != nil {
+			log.Printf("Stream %q: failed to send upstream NACK: %v", publisher.StreamID, err)
+		}
+	}
+
+	if canPLI {
+		if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+			log.Printf("Stream %q: failed to send recovery PLI: %v", publisher.StreamID, err)
+		}
+	}
+}
+
+// seq16Gt reports whether a is "after" b in RTP sequence-number space,
+// accounting for 16-bit wraparound (RFC 3550 §A.1).
+func seq16Gt(a, b uint16) bool {
+	return (int16)(a-b) > 0
+}
+
+// serveNACKsFromCache answers a downstream receiver's TransportLayerNack
+// out of the publisher's packet cache, retransmitting on whichever
+// simulcast layer rc is actually subscribed to (the same lookup
+// selectLayerForReceiver does) rather than always the top layer - a
+// receiver hot-swapped onto a lower layer would otherwise never get its
+// losses served. No RTX payload type has been negotiated on the
+// receiver's PeerConnection yet, so recovered packets are
+// plain-retransmitted on the original video track/SSRC.
+func (s *Server) serveNACKsFromCache(publisher *Publisher, rc *ReceiverClient, raw []byte) {
+	packets, err := rtcp.Unmarshal(raw)
+	if err != nil {
+		return
+	}
+
+	for _, pkt := range packets {
+		nack, ok := pkt.(*rtcp.TransportLayerNack)
+		if !ok {
+			continue
+		}
+
+		rc.layerMu.Lock()
+		rid := rc.currentLayer
+		rc.layerMu.Unlock()
+
+		publisher.mu.Lock()
+		track := publisher.Layers[rid]
+		if track == nil {
+			track = publisher.VideoTrack
+		}
+		publisher.mu.Unlock()
+		if track == nil || publisher.Cache == nil {
+			continue
+		}
+
+		for _, pair := range nack.Nacks {
+			for _, seq := range pair.PacketList() {
+				cached, found := publisher.Cache.Get(seq)
+				if !found {
+					continue
+				}
+				if err := track.WriteRTP(cached); err != nil && err != io.ErrClosedPipe {
+					log.Printf("Stream %q: failed to retransmit seq %d to %s: %v", publisher.StreamID, seq, rc.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// selectLayerForReceiver picks the simulcast layer (or the publisher's
+// single VideoTrack, if it isn't publishing simulcast) a receiver should be
+// forwarded based on its current bandwidth estimate. It records a chosen
+// simulcast RID in rc.currentLayer but does not perform the hot-swap
+// itself; callers compare rc.currentLayer from before and after the call.
+func (s *Server) selectLayerForReceiver(publisher *Publisher, rc *ReceiverClient) *webrtc.TrackLocalStaticRTP {
+	publisher.mu.Lock()
+	layers := publisher.Layers
+	fallback := publisher.VideoTrack
+	publisher.mu.Unlock()
+
+	if len(layers) <= 1 {
+		return fallback
+	}
+
+	estimate := uint64(0)
+	if rc.Estimator != nil {
+		estimate = rc.Estimator.Estimate()
+	}
+
+	rid := chooseLayer(estimate, layers)
+	if rid == "" {
+		return fallback
+	}
+	rc.layerMu.Lock()
+	rc.currentLayer = rid
+	rc.layerMu.Unlock()
+	return layers[rid]
+}
+
+// handleReceiverFeedback folds REMB reports from a receiver into its
+// bitrate estimator and, when the resulting estimate crosses a simulcast
+// ladder boundary, hot-swaps the forwarded track and requests a keyframe
+// on the newly selected layer.
+func (s *Server) handleReceiverFeedback(publisher *Publisher, rc *ReceiverClient, raw []byte) {
+	if rc.Estimator == nil {
+		return
+	}
+
+	packets, err := rtcp.Unmarshal(raw)
+	if err != nil {
+		return
+	}
+
+	gotREMB := false
+	for _, pkt := range packets {
+		remb, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate)
+		if !ok {
+			continue
+		}
+		rc.Estimator.OnREMB(uint64(remb.Bitrate))
+		gotREMB = true
+	}
+	if !gotREMB {
+		return
+	}
+
+	publisher.mu.Lock()
+	numLayers := len(publisher.Layers)
+	publisher.mu.Unlock()
+	if numLayers <= 1 {
+		return
+	}
+
+	rc.layerMu.Lock()
+	previous := rc.currentLayer
+	rc.layerMu.Unlock()
+
+	next := s.selectLayerForReceiver(publisher, rc)
+	if next == nil {
+		return
+	}
+
+	rc.layerMu.Lock()
+	current := rc.currentLayer
+	switched := current != previous
+	rc.layerMu.Unlock()
+	if !switched || rc.RTPSender == nil {
+		return
+	}
+
+	if err := rc.PC.RemoveTrack(rc.RTPSender); err != nil {
+		log.Printf("Receiver %s: failed to remove track during layer switch: %v", rc.ID, err)
+		return
+	}
+	newSender, err := rc.PC.AddTrack(next)
+	if err != nil {
+		log.Printf("Receiver %s: failed to add track during layer switch: %v", rc.ID, err)
+		return
+	}
+	rc.RTPSender = newSender
+	log.Printf("Receiver %s: switched simulcast layer to %q", rc.ID, rc.currentLayer)
+
+	if publisher.PC != nil {
+		for _, recv := range publisher.PC.GetReceivers() {
+			for _, track := range recv.Tracks() {
+				if track.Kind() == webrtc.RTPCodecTypeVideo && track.RID() == current {
+					publisher.PC.WriteRTCP([]rtcp.Packet{
+						&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+					})
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	s.publishersMu.RLock()
+	streams := make([]string, 0, len(s.publishers))
+	for id := range s.publishers {
+		streams = append(streams, id)
+	}
+	s.publishersMu.RUnlock()
+
+	status := false
+	if publisher, ok := s.getPublisher(defaultStreamID); ok {
+		status = publisher.Connected
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sender_url":    s.senderURL,
+		"status":        status,
+		"num_receivers": len(s.receiversFor(defaultStreamID)),
+		"streams":       streams,
+	})
+}
+
+// handleStats exposes each stream's current clock-sync offset/RTT (the
+// minimum-RTT sample kept by runClockSync) and receiver count, for
+// debugging glass-to-glass latency without instrumenting the browser.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	s.publishersMu.RLock()
+	streams := make(map[string]interface{}, len(s.publishers))
+	for id, publisher := range s.publishers {
+		publisher.clockMu.Lock()
+		offset := publisher.ClockOffsetMs
+		rtt := publisher.ClockRTTMs
+		publisher.clockMu.Unlock()
+
+		streams[id] = map[string]interface{}{
+			"connected":     publisher.Connected,
+			"offset_ms":     offset,
+			"rtt_ms":        rtt,
+			"num_receivers": len(s.receiversFor(id)),
+		}
+	}
+	s.publishersMu.RUnlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"streams": streams})
+}
+
+func main() {
+	httpPort := 8080
+	senderURL := "Python Sender via WebSocket"
+
+	server := NewServer(senderURL)
+
+	// Serve static files
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.ServeFile(w, r, "./static/index.html")
+			return
+		}
+		fs := http.FileServer(http.Dir("./static"))
+		fs.ServeHTTP(w, r)
+	})
+
+	http.HandleFunc("/ws", server.handleWebSocket)
+	http.HandleFunc("/offer", server.handleOffer)
+	http.HandleFunc("/config", server.handleConfig)
+	http.HandleFunc("/stats", server.handleStats)
+
+	// WHIP (ingest) and WHEP (playback) for the default stream. The
+	// collection endpoints create a resource; PATCH/DELETE against
+	// /whip/{id} or /whep/{id} manage it.
+	http.HandleFunc("/whip", server.handleWHIP)
+	http.HandleFunc("/whip/", server.handleWHIPResource)
+	http.HandleFunc("/whep", server.handleWHEP)
+	http.HandleFunc("/whep/", server.handleWHIPResource)
+
+	// Named-stream SFU endpoints: /publish/{stream} and /subscribe/{stream}.
+	http.HandleFunc("/publish/", server.handlePublishPath)
+	http.HandleFunc("/subscribe/", server.handleSubscribePath)
+
+	http.HandleFunc("/client.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		http.ServeFile(w, r, "./static/client.js")
+	})
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("WebRTC Server Running"))
+	})
+
+	separator := strings.Repeat("=", 60)
+
+	log.Println(separator)
+	log.Println("WebRTC SFU Server Starting...")
+	log.Println(separator)
+	log.Printf("WebSocket endpoint: ws://localhost:%d/ws?stream={name}", httpPort)
+	log.Printf("WHIP endpoint: http://localhost:%d/whip", httpPort)
+	log.Printf("WHEP endpoint: http://localhost:%d/whep", httpPort)
+	log.Printf("Named publish:   http://localhost:%d/publish/{stream}", httpPort)
+	log.Printf("Named subscribe: http://localhost:%d/subscribe/{stream}", httpPort)
+	log.Printf("Web interface: http://localhost:%d", httpPort)
+	log.Println(separator)
+
+	addr := fmt.Sprintf(":%d", httpPort)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Fatal("!! Server failed to start:", err)
+	}
+}
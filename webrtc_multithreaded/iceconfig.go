@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEServerConfig is one STUN/TURN server entry, close enough to
+// webrtc.ICEServer's JSON shape to unmarshal straight out of ICE_CONFIG_FILE.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Config controls everything about how this relay's PeerConnections reach
+// the network: which STUN/TURN servers to offer, whether to run ICE-Lite
+// behind a public IP, and the ephemeral port range and liveness timeouts
+// operators need to get through a firewall behind restrictive NATs.
+type Config struct {
+	ICEServers []ICEServerConfig `json:"iceServers"`
+
+	// ICELite tells pion this relay always sits behind a public or
+	// port-forwarded address, so it can skip full ICE and just offer its
+	// host candidate.
+	ICELite bool `json:"iceLite"`
+
+	// NAT1To1IPs is advertised as ICECandidateTypeHost alongside discovered
+	// host candidates - set this when the relay sits behind a 1:1 NAT or
+	// port-forward rather than a symmetric NAT that actually needs a TURN
+	// relay.
+	NAT1To1IPs []string `json:"nat1To1IPs"`
+
+	EphemeralUDPPortMin uint16 `json:"ephemeralUDPPortMin"`
+	EphemeralUDPPortMax uint16 `json:"ephemeralUDPPortMax"`
+
+	DisconnectedTimeout time.Duration `json:"disconnectedTimeout"`
+	FailedTimeout       time.Duration `json:"failedTimeout"`
+	KeepAliveInterval   time.Duration `json:"keepAliveInterval"`
+}
+
+// defaultConfig matches the single hard-coded Google STUN server this relay
+// shipped with before Config existed.
+func defaultConfig() Config {
+	return Config{
+		ICEServers: []ICEServerConfig{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	}
+}
+
+// configFromEnv builds a Config from environment variables, falling back to
+// defaultConfig for anything unset. ICE_CONFIG_FILE, if set, is read as JSON
+// and takes precedence over the rest of the env vars below.
+func configFromEnv() Config {
+	if path := os.Getenv("ICE_CONFIG_FILE"); path != "" {
+		cfg := defaultConfig()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("ICE config: failed to read %q, falling back to env/defaults: %v", path, err)
+		} else if err := json.Unmarshal(data, &cfg); err != nil {
+			log.Printf("ICE config: failed to parse %q, falling back to env/defaults: %v", path, err)
+		} else {
+			return cfg
+		}
+	}
+
+	cfg := defaultConfig()
+
+	if urls := os.Getenv("ICE_SERVERS"); urls != "" {
+		cfg.ICEServers = []ICEServerConfig{{
+			URLs:       strings.Split(urls, ","),
+			Username:   os.Getenv("ICE_USERNAME"),
+			Credential: os.Getenv("ICE_CREDENTIAL"),
+		}}
+	}
+
+	cfg.ICELite = os.Getenv("ICE_LITE") == "true"
+
+	if ip := os.Getenv("NAT_1TO1_IP"); ip != "" {
+		cfg.NAT1To1IPs = []string{ip}
+	}
+
+	if min, ok := uint16FromEnv("ICE_UDP_PORT_MIN"); ok {
+		cfg.EphemeralUDPPortMin = min
+	}
+	if max, ok := uint16FromEnv("ICE_UDP_PORT_MAX"); ok {
+		cfg.EphemeralUDPPortMax = max
+	}
+
+	if d, ok := secondsFromEnv("ICE_DISCONNECTED_TIMEOUT"); ok {
+		cfg.DisconnectedTimeout = d
+	}
+	if d, ok := secondsFromEnv("ICE_FAILED_TIMEOUT"); ok {
+		cfg.FailedTimeout = d
+	}
+	if d, ok := secondsFromEnv("ICE_KEEPALIVE_INTERVAL"); ok {
+		cfg.KeepAliveInterval = d
+	}
+
+	return cfg
+}
+
+func uint16FromEnv(key string) (uint16, bool) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 || n > 65535 {
+		log.Printf("Invalid %s %q, ignoring", key, raw)
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+func secondsFromEnv(key string) (time.Duration, bool) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid %s %q, ignoring", key, raw)
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// webrtcICEServers converts cfg.ICEServers to what webrtc.Configuration
+// wants.
+func (cfg Config) webrtcICEServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+	for _, s := range cfg.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		})
+	}
+	return servers
+}
+
+// settingEngine builds the pion SettingEngine this Config describes, so
+// NewServer can build its api around it once at startup - letting a single
+// relay run behind one firewalled UDP port with a public IP mapping instead
+// of needing a full symmetric-NAT-capable TURN deployment.
+func (cfg Config) settingEngine() webrtc.SettingEngine {
+	var se webrtc.SettingEngine
+
+	se.SetLite(cfg.ICELite)
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	if cfg.EphemeralUDPPortMin > 0 && cfg.EphemeralUDPPortMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(cfg.EphemeralUDPPortMin, cfg.EphemeralUDPPortMax); err != nil {
+			log.Printf("ICE config: invalid ephemeral port range %d-%d: %v", cfg.EphemeralUDPPortMin, cfg.EphemeralUDPPortMax, err)
+		}
+	}
+
+	if cfg.DisconnectedTimeout > 0 || cfg.FailedTimeout > 0 || cfg.KeepAliveInterval > 0 {
+		se.SetICETimeouts(cfg.DisconnectedTimeout, cfg.FailedTimeout, cfg.KeepAliveInterval)
+	}
+
+	return se
+}
@@ -19,14 +19,20 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
+
+	"multithreaded_webrtc/signaling"
 )
 
 // =============================================================================
@@ -44,6 +50,15 @@ type OfferRequest struct {
 	Type string `json:"type"`
 }
 
+// WHIPSession tracks a WHIP (ingest) or WHEP (playback) resource so a
+// later DELETE can find the PeerConnection it applies to. The resource ID
+// is handed back to the client in the Location header of the initial POST
+// response.
+type WHIPSession struct {
+	ID string
+	PC *webrtc.PeerConnection
+}
+
 type TimestampMessage struct {
 	Type        string  `json:"type"`
 	Seq         int64   `json:"seq,omitempty"`
@@ -56,6 +71,213 @@ type TimestampMessage struct {
 	ServerTime  float64 `json:"server_time,omitempty"`
 }
 
+// SubscribeMessage requests the server add or remove transceivers for the
+// given stream IDs on the sender's "timestamps" DataChannel, so one browser
+// PeerConnection can watch several named streams without opening one
+// PeerConnection per camera. The server answers by renegotiating: see
+// subscribeStreams/unsubscribeStreams and the "offer"/"answer" messages
+// they exchange with the browser over the same channel.
+type SubscribeMessage struct {
+	Type    string   `json:"type"`
+	Streams []string `json:"streams,omitempty"`
+}
+
+// latencyBucketsMs are the upper bounds, in milliseconds, of the
+// glass-to-glass latency histogram exposed on /metrics, covering
+// sub-frame jitter up to multi-second stalls.
+var latencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// LatencyHistogram is a minimal Prometheus-style cumulative histogram over
+// latencyBucketsMs, safe for concurrent Observe/Snapshot calls.
+type LatencyHistogram struct {
+	mu      sync.Mutex
+	buckets []uint64 // parallel to latencyBucketsMs, each a running total of samples <= bound
+	sum     float64
+	count   uint64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{buckets: make([]uint64, len(latencyBucketsMs))}
+}
+
+// Observe records one latency sample, in milliseconds.
+func (h *LatencyHistogram) Observe(ms float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += ms
+	h.count++
+}
+
+// Snapshot returns a copy of the current bucket counts plus the running
+// sum/count, for rendering _bucket/_sum/_count series.
+func (h *LatencyHistogram) Snapshot() (buckets []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets = make([]uint64, len(h.buckets))
+	copy(buckets, h.buckets)
+	return buckets, h.sum, h.count
+}
+
+// peerConnLabel is the role/state pair handleMetrics groups
+// webrtc_peerconnections by.
+type peerConnLabel struct {
+	role  string
+	state string
+}
+
+// iceCandidateLabel is the protocol/type/used triple handleMetrics groups
+// webrtc_ice_candidates_total by.
+type iceCandidateLabel struct {
+	protocol string
+	typ      string
+	used     bool
+}
+
+// setPeerConnectionState records id (any caller-chosen string unique to one
+// PeerConnection, e.g. a receiver or WHIP/WHEP resource ID) as being in
+// state under role, for the webrtc_peerconnections gauge. Closed/failed
+// connections are dropped instead of kept at their last state, so the gauge
+// only ever reports connections that are still around.
+func (s *Server) setPeerConnectionState(id, role string, state webrtc.PeerConnectionState) {
+	s.peerConnMu.Lock()
+	defer s.peerConnMu.Unlock()
+
+	if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+		delete(s.peerConnStates, id)
+		return
+	}
+	s.peerConnStates[id] = peerConnLabel{role: role, state: state.String()}
+}
+
+// peerConnectionCounts tallies the current peerConnStates into one count per
+// distinct role/state pair.
+func (s *Server) peerConnectionCounts() map[peerConnLabel]int {
+	s.peerConnMu.Lock()
+	defer s.peerConnMu.Unlock()
+
+	counts := make(map[peerConnLabel]int, len(s.peerConnStates))
+	for _, label := range s.peerConnStates {
+		counts[label]++
+	}
+	return counts
+}
+
+// recordICECandidate tallies one locally-gathered ICE candidate for the
+// webrtc_ice_candidates_total{used="false"} series. Call this from
+// OnICECandidate; recordNominatedCandidate separately tallies whichever
+// candidate a connection actually ends up using.
+func (s *Server) recordICECandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		return
+	}
+	s.iceCandidatesMu.Lock()
+	defer s.iceCandidatesMu.Unlock()
+	s.iceCandidates[iceCandidateLabel{protocol: c.Protocol.String(), typ: c.Typ.String(), used: false}]++
+}
+
+// recordNominatedCandidate tallies the local candidate of a connection's
+// selected ICE pair for the webrtc_ice_candidates_total{used="true"} series.
+// Call this once a PeerConnection reaches Connected, passing the local
+// ICECandidateStats pulled out of its GetStats() nominated pair.
+func (s *Server) recordNominatedCandidate(protocol, candidateType string) {
+	s.iceCandidatesMu.Lock()
+	defer s.iceCandidatesMu.Unlock()
+	s.iceCandidates[iceCandidateLabel{protocol: protocol, typ: candidateType, used: true}]++
+}
+
+// iceCandidateCounts returns a copy of the current gathered/used candidate
+// tallies.
+func (s *Server) iceCandidateCounts() map[iceCandidateLabel]uint64 {
+	s.iceCandidatesMu.Lock()
+	defer s.iceCandidatesMu.Unlock()
+
+	counts := make(map[iceCandidateLabel]uint64, len(s.iceCandidates))
+	for k, v := range s.iceCandidates {
+		counts[k] = v
+	}
+	return counts
+}
+
+// recordNominatedCandidateFromStats looks through pc's current stats report
+// for its nominated ICE candidate pair and tallies the local candidate it
+// names, if any is found yet.
+func (s *Server) recordNominatedCandidateFromStats(pc *webrtc.PeerConnection) {
+	stats := pc.GetStats()
+	for _, stat := range stats {
+		pair, ok := stat.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated {
+			continue
+		}
+		if local, ok := stats[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			s.recordNominatedCandidate(local.Protocol, local.CandidateType.String())
+		}
+		return
+	}
+}
+
+// recordKeyframeRequest counts one PLI/FIR sent for ssrc and starts the
+// clock observeKeyframeArrival stops once that stream's next keyframe
+// actually arrives.
+func (s *Server) recordKeyframeRequest(ssrc webrtc.SSRC) {
+	atomic.AddUint64(&s.keyframeRequests, 1)
+
+	s.keyframeRequestedAtMu.Lock()
+	defer s.keyframeRequestedAtMu.Unlock()
+	s.keyframeRequestedAt[ssrc] = time.Now()
+}
+
+// observeKeyframeArrival records, into keyframeLatencyHist, how long it's
+// been since the last recordKeyframeRequest for ssrc - a no-op if no request
+// is outstanding, which is the common case for every non-keyframe packet and
+// for keyframes that weren't explicitly requested.
+func (s *Server) observeKeyframeArrival(ssrc webrtc.SSRC) {
+	s.keyframeRequestedAtMu.Lock()
+	requestedAt, ok := s.keyframeRequestedAt[ssrc]
+	if ok {
+		delete(s.keyframeRequestedAt, ssrc)
+	}
+	s.keyframeRequestedAtMu.Unlock()
+
+	if !ok {
+		return
+	}
+	s.keyframeLatencyHist.Observe(float64(time.Since(requestedAt).Milliseconds()))
+}
+
+// recordRTPForwarded tallies one packet forwardSenderVideoTrack/
+// forwardSenderAudioTrack actually relayed to receivers, for the
+// webrtc_rtp_packets_forwarded_total/webrtc_rtp_bytes_forwarded_total series.
+func (s *Server) recordRTPForwarded(ssrc webrtc.SSRC, pkt *rtp.Packet) {
+	s.rtpForwardedMu.Lock()
+	defer s.rtpForwardedMu.Unlock()
+	s.rtpPacketsForwarded[ssrc]++
+	s.rtpBytesForwarded[ssrc] += uint64(pkt.MarshalSize())
+}
+
+// rtpForwardedSnapshot returns a copy of the current per-SSRC forwarded
+// packet/byte counts.
+func (s *Server) rtpForwardedSnapshot() (packets, bytes map[webrtc.SSRC]uint64) {
+	s.rtpForwardedMu.Lock()
+	defer s.rtpForwardedMu.Unlock()
+
+	packets = make(map[webrtc.SSRC]uint64, len(s.rtpPacketsForwarded))
+	for k, v := range s.rtpPacketsForwarded {
+		packets[k] = v
+	}
+	bytes = make(map[webrtc.SSRC]uint64, len(s.rtpBytesForwarded))
+	for k, v := range s.rtpBytesForwarded {
+		bytes[k] = v
+	}
+	return packets, bytes
+}
+
 // =============================================================================
 // Receiver Client with Non-Blocking Send
 // =============================================================================
@@ -66,13 +288,49 @@ type ReceiverClient struct {
 	DataChannel *webrtc.DataChannel
 	sendChan    chan string // Buffered channel for non-blocking sends
 	closed      int32       // Atomic flag
+
+	// Subscriptions tracks the RTPSender added for each stream this
+	// receiver has batch-subscribed to over the DataChannel, so a later
+	// unsubscribe can find the right one to pc.RemoveTrack.
+	subsMu        sync.Mutex
+	Subscriptions map[string]*webrtc.RTPSender
+
+	// PLICount/NACKCount count RTCP feedback forwarded from this receiver
+	// by forwardReceiverRTCP; LatencyHist holds the glass-to-glass latency
+	// samples from the ping/pong exchange in the "timestamps" DataChannel
+	// handler. All three feed /metrics and /api/v1/receivers.
+	PLICount    uint64 // atomic
+	NACKCount   uint64 // atomic
+	LatencyHist *LatencyHistogram
+
+	// Estimator folds this receiver's REMB reports into a bandwidth
+	// estimate; currentLayer/pendingLayer track, per subscribed stream,
+	// which simulcast RID is forwarded and which one a bandwidth change
+	// is waiting to switch to once that layer's next keyframe arrives
+	// (see maybeScheduleLayerSwitch/promotePendingReceivers).
+	Estimator *bitrateEstimator
+
+	layerMu      sync.Mutex
+	currentLayer map[string]string
+	pendingLayer map[string]string
+
+	// statsMu guards the previous GetStats() sample used to turn a
+	// cumulative byte count into a current bitrate in receiverSnapshots.
+	statsMu       sync.Mutex
+	lastBytesSent uint64
+	lastStatsAt   time.Time
 }
 
 func NewReceiverClient(id string, pc *webrtc.PeerConnection) *ReceiverClient {
 	r := &ReceiverClient{
-		ID:       id,
-		PC:       pc,
-		sendChan: make(chan string, 100), // Buffer 100 messages
+		ID:            id,
+		PC:            pc,
+		sendChan:      make(chan string, 100), // Buffer 100 messages
+		Subscriptions: make(map[string]*webrtc.RTPSender),
+		LatencyHist:   NewLatencyHistogram(),
+		Estimator:     newBitrateEstimator(),
+		currentLayer:  make(map[string]string),
+		pendingLayer:  make(map[string]string),
 	}
 	go r.sendLoop()
 	return r
@@ -121,25 +379,492 @@ type Server struct {
 	receivers   map[string]*ReceiverClient
 	receiversMu sync.RWMutex
 
+	// videoTrack mirrors videoTracks[defaultStreamID], kept around so the
+	// original single-stream /offer endpoint keeps working unchanged.
 	videoTrack *webrtc.TrackLocalStaticRTP
 
+	// audioTrack mirrors audioTracks[defaultStreamID], same reasoning as
+	// videoTrack above.
+	audioTrack *webrtc.TrackLocalStaticRTP
+
+	// videoTracks holds one outgoing track per named stream a sender has
+	// published, so a single browser PeerConnection can batch-subscribe to
+	// several of them at once (see subscribeStreams/unsubscribeStreams).
+	videoTracks map[string]*webrtc.TrackLocalStaticRTP
+
+	// audioTracks mirrors videoTracks for a stream's Opus track, when the
+	// sender publishes one alongside its video.
+	audioTracks map[string]*webrtc.TrackLocalStaticRTP
+	streamsMu   sync.RWMutex
+
+	// streamSSRC holds the upstream SSRC for each named stream's layer
+	// (keyed by RID, "" when the sender isn't publishing simulcast), so
+	// runPLIScheduler can ask the sender for a keyframe on every layer
+	// without reaching back into each OnTrack closure.
+	streamSSRC map[string]map[string]webrtc.SSRC
+
+	// videoCaches holds, per named stream and layer (keyed by RID, ""
+	// when the sender isn't publishing simulcast), the last
+	// defaultCacheSize upstream RTP packets, so a downstream NACK can be
+	// served out of the layer the receiver actually subscribes to instead
+	// of round-tripping to the sender (see serveNACKFromCache).
+	videoCaches map[string]map[string]*packetCache
+	videoJitter map[string]*jitterEstimator
+
+	// streamLayers holds every simulcast RID's local track for a named
+	// stream (keyed by RID, "" when the sender isn't publishing
+	// simulcast), so selectLayerForReceiver can pick the best one a
+	// receiver's estimated bandwidth can afford. videoTracks holds the
+	// "f" layer once it arrives, else the first layer to arrive, for
+	// callers that don't care.
+	streamLayers map[string]map[string]*webrtc.TrackLocalStaticRTP
+
+	// WHIP/WHEP resources, keyed by the resource ID returned in Location.
+	sessions   map[string]*WHIPSession
+	sessionsMu sync.RWMutex
+
+	// room tracks every connected peer (sender and receivers alike) and
+	// which named streams each has published, so the server isn't
+	// hardcoded to one publisher and N subscribers. See handleWebSocket's
+	// protoo-style join/publish/close dispatch and handleOffer,
+	// which now shims onto the same room.
+	room *signaling.Room
+
+	// recorder segments every forwarded stream to disk for the
+	// /recordings and /replay endpoints. See recorder.go.
+	recorder *recorder
+
+	// api and pcConfig are built once in NewServer from the ICE Config
+	// (env vars or a JSON file, see iceconfig.go) and shared by every PeerConnection
+	// the relay creates, so operators can run it behind a single firewalled
+	// UDP port with a public IP mapping.
+	api      *webrtc.API
+	pcConfig webrtc.Configuration
+
+	// peerConnStates holds the last reported state of every PeerConnection
+	// this relay has created, keyed by a caller-chosen connection id, so
+	// handleMetrics can render webrtc_peerconnections as a gauge per
+	// role/state without the relay having to keep a live pc reference
+	// around just for that. Entries are removed once a connection closes.
+	peerConnMu     sync.Mutex
+	peerConnStates map[string]peerConnLabel
+
+	// iceCandidates counts every local ICE candidate this relay has
+	// gathered (from OnICECandidate) and every one that ended up on a
+	// connection's nominated pair (from its connected GetStats()), both
+	// keyed by protocol/type - see recordICECandidate/recordNominatedCandidate.
+	iceCandidatesMu sync.Mutex
+	iceCandidates   map[iceCandidateLabel]uint64
+
+	// rtpPacketsForwarded/rtpBytesForwarded count what forwardSenderVideoTrack/
+	// forwardSenderAudioTrack actually relay to receivers, keyed by the
+	// upstream track's SSRC.
+	rtpForwardedMu      sync.Mutex
+	rtpPacketsForwarded map[webrtc.SSRC]uint64
+	rtpBytesForwarded   map[webrtc.SSRC]uint64
+
+	// keyframeRequests counts every PLI/FIR this relay has sent upstream,
+	// and keyframeLatencyHist measures how long it took the next keyframe
+	// to actually arrive after each one, keyed transiently by SSRC in
+	// keyframeRequestedAt - see recordKeyframeRequest/observeKeyframeArrival.
+	keyframeRequests      uint64
+	keyframeRequestedAtMu sync.Mutex
+	keyframeRequestedAt   map[webrtc.SSRC]time.Time
+	keyframeLatencyHist   *LatencyHistogram
+
 	mu sync.Mutex
 
+	// PLI is how often runPLIScheduler asks the sender for a fresh
+	// keyframe while at least one receiver is connected. Populated from
+	// the PLI_INTERVAL env var in main.
+	PLI time.Duration
+
 	// Stats
 	timestampCount uint64
 	lastLogTime    time.Time
 }
 
-func NewServer() *Server {
+// defaultStreamID is used when a sender doesn't specify a ?stream= name,
+// so existing single-camera setups keep working without changes.
+const defaultStreamID = "default"
+
+// defaultCacheSize is how many packets videoCaches holds per upstream
+// track, enough to cover a NACK round trip without using much memory.
+const defaultCacheSize = 512
+
+func NewServer(pliInterval time.Duration, recordDir string, recordSegment time.Duration, iceConfig Config) *Server {
+	rec, err := newRecorder(recordDir, recordSegment)
+	if err != nil {
+		log.Printf("Recorder: disabled, failed to prepare %q: %v", recordDir, err)
+		rec = nil
+	}
+
 	return &Server{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		receivers:   make(map[string]*ReceiverClient),
+		receivers:    make(map[string]*ReceiverClient),
+		videoTracks:  make(map[string]*webrtc.TrackLocalStaticRTP),
+		audioTracks:  make(map[string]*webrtc.TrackLocalStaticRTP),
+		streamSSRC:   make(map[string]map[string]webrtc.SSRC),
+		videoCaches:  make(map[string]map[string]*packetCache),
+		videoJitter:  make(map[string]*jitterEstimator),
+		streamLayers: make(map[string]map[string]*webrtc.TrackLocalStaticRTP),
+		sessions:     make(map[string]*WHIPSession),
+		room:         signaling.NewRoom(),
+		recorder:     rec,
+		api:          newWebRTCAPI(iceConfig.settingEngine()),
+		pcConfig:     webrtc.Configuration{ICEServers: iceConfig.webrtcICEServers()},
+
+		peerConnStates:      make(map[string]peerConnLabel),
+		iceCandidates:       make(map[iceCandidateLabel]uint64),
+		rtpPacketsForwarded: make(map[webrtc.SSRC]uint64),
+		rtpBytesForwarded:   make(map[webrtc.SSRC]uint64),
+		keyframeRequestedAt: make(map[webrtc.SSRC]time.Time),
+		keyframeLatencyHist: NewLatencyHistogram(),
+
+		PLI:         pliInterval,
 		lastLogTime: time.Now(),
 	}
 }
 
+// videoRTCPFeedback advertises nack and nack-pli support on every video
+// codec below, so browsers actually send TransportLayerNack on loss
+// instead of waiting out a full PLI-driven keyframe (see serveNACKFromCache).
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// videoCodecs is registered on every Server's api in priority order, so
+// whichever one a sender/browser actually offers gets negotiated instead of
+// the relay assuming a single hard-coded video codec.
+var videoCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: 102,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
+		PayloadType: 96,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP9,
+			ClockRate:    90000,
+			SDPFmtpLine:  "profile-id=0",
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: 98,
+	},
+}
+
+var audioCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	},
+}
+
+// newWebRTCAPI builds a webrtc.API with videoCodecs/audioCodecs registered
+// and se applied, so every PeerConnection the relay creates can negotiate
+// whichever codec the other side offers, through whatever ICE posture se
+// describes (see Config.settingEngine).
+func newWebRTCAPI(se webrtc.SettingEngine) *webrtc.API {
+	m := &webrtc.MediaEngine{}
+	for _, c := range videoCodecs {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			log.Fatalf("Failed to register video codec %s: %v", c.MimeType, err)
+		}
+	}
+	for _, c := range audioCodecs {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeAudio); err != nil {
+			log.Fatalf("Failed to register audio codec %s: %v", c.MimeType, err)
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		log.Fatalf("Failed to register default interceptors: %v", err)
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se))
+}
+
+// newPeerConnection creates a PeerConnection through s.api instead of the
+// package-level default, so the negotiated codecs and ICE Config set up in
+// NewServer are actually offered/accepted.
+func (s *Server) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return s.api.NewPeerConnection(s.pcConfig)
+}
+
+// KeyframeDetector recognizes whether an RTP payload for a negotiated video
+// codec starts a new keyframe, so the forwarding loop isn't tied to one
+// hard-coded codec's bitstream layout.
+type KeyframeDetector interface {
+	IsKeyFrame(payload []byte) bool
+}
+
+type h264KeyframeDetector struct{}
+
+// IsKeyFrame looks for a SPS/PPS/IDR NAL unit (types 7/8/5), including one
+// aggregated inside a STAP-A packet (type 24) rather than sent on its own.
+func (h264KeyframeDetector) IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch payload[0] & 0x1F {
+	case 5, 7, 8:
+		return true
+	case 24: // STAP-A: walk the aggregated NAL units
+		i := 1
+		for i+2 <= len(payload) {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if size < 1 || i+size > len(payload) {
+				return false
+			}
+			switch payload[i] & 0x1F {
+			case 5, 7, 8:
+				return true
+			}
+			i += size
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+type vp8KeyframeDetector struct{}
+
+// IsKeyFrame checks the VP8 payload header's P bit, skipping the optional
+// extended-control-bits octets first.
+func (vp8KeyframeDetector) IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 { // X bit: extended control bits present
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		if ext&0x80 != 0 {
+			offset++ // I: PictureID
+			if len(payload) > 2 && payload[2]&0x80 != 0 {
+				offset++ // M: 15-bit PictureID takes a second octet
+			}
+		}
+		if ext&0x40 != 0 {
+			offset++ // L: TL0PICIDX
+		}
+		if ext&0x30 != 0 {
+			offset++ // T/K: TID/KEYIDX
+		}
+		offset++
+	}
+	if len(payload) <= offset {
+		return false
+	}
+	return payload[offset]&0x01 == 0
+}
+
+type vp9KeyframeDetector struct{}
+
+// IsKeyFrame checks the VP9 RTP payload descriptor's P bit.
+func (vp9KeyframeDetector) IsKeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x40 == 0
+}
+
+// keyFrameDetectorFor returns the KeyframeDetector for a negotiated video
+// MIME type, or nil if none is known (the periodic PLI/FIR loop just keeps
+// asking in that case rather than assuming no keyframe ever arrives).
+func keyFrameDetectorFor(mimeType string) KeyframeDetector {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		return h264KeyframeDetector{}
+	case webrtc.MimeTypeVP8:
+		return vp8KeyframeDetector{}
+	case webrtc.MimeTypeVP9:
+		return vp9KeyframeDetector{}
+	default:
+		return nil
+	}
+}
+
+// packetCache is a ring buffer of the last N RTP packets on an upstream
+// track, keyed by sequence number, so a NACK from a downstream receiver can
+// be served locally instead of waiting for the sender to resend.
+type packetCache struct {
+	mu      sync.Mutex
+	packets []*rtp.Packet
+	seqs    []uint16
+	valid   []bool
+}
+
+func newPacketCache(size int) *packetCache {
+	return &packetCache{
+		packets: make([]*rtp.Packet, size),
+		seqs:    make([]uint16, size),
+		valid:   make([]bool, size),
+	}
+}
+
+func (c *packetCache) Store(pkt *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := int(pkt.SequenceNumber) % len(c.packets)
+	c.packets[idx] = pkt
+	c.seqs[idx] = pkt.SequenceNumber
+	c.valid[idx] = true
+}
+
+func (c *packetCache) Get(seq uint16) (*rtp.Packet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := int(seq) % len(c.packets)
+	if !c.valid[idx] || c.seqs[idx] != seq {
+		return nil, false
+	}
+	return c.packets[idx], true
+}
+
+// jitterEstimator tracks inter-arrival jitter using the RFC 3550 §6.4.1
+// running estimate: J += (|D| - J) / 16, where D is the difference in
+// relative transit time between two packets.
+type jitterEstimator struct {
+	mu            sync.Mutex
+	clockRate     float64
+	haveLast      bool
+	lastTransit   float64
+	lastTimestamp uint32
+	jitter        float64
+}
+
+func newJitterEstimator(clockRate uint32) *jitterEstimator {
+	return &jitterEstimator{clockRate: float64(clockRate)}
+}
+
+// Update feeds one packet's RTP timestamp and wall-clock arrival time into
+// the estimator and returns the current jitter estimate in milliseconds.
+func (j *jitterEstimator) Update(rtpTimestamp uint32, arrival time.Time) float64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	arrivalUnits := arrival.Sub(time.Unix(0, 0)).Seconds() * j.clockRate
+	transit := arrivalUnits - float64(rtpTimestamp)
+
+	if j.haveLast {
+		d := transit - j.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		j.jitter += (d - j.jitter) / 16
+	}
+
+	j.lastTransit = transit
+	j.lastTimestamp = rtpTimestamp
+	j.haveLast = true
+
+	return (j.jitter / j.clockRate) * 1000
+}
+
+// bitrateEstimator keeps the most recent REMB value a receiver reported
+// along with a measured send rate, and that's the estimate simulcast layer
+// selection acts on. A full Transport-CC implementation would derive the
+// estimate from per-packet feedback instead of trusting REMB outright.
+type bitrateEstimator struct {
+	mu          sync.Mutex
+	rembBps     uint64
+	sentBytes   uint64
+	windowStart time.Time
+	measuredBps uint64
+}
+
+func newBitrateEstimator() *bitrateEstimator {
+	return &bitrateEstimator{windowStart: time.Now()}
+}
+
+// OnREMB records a browser-reported REMB ceiling.
+func (b *bitrateEstimator) OnREMB(bps uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rembBps = bps
+}
+
+// OnPacketSent feeds the estimator's own throughput measurement, folding
+// over a 1s window.
+func (b *bitrateEstimator) OnPacketSent(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sentBytes += uint64(n)
+	if elapsed := time.Since(b.windowStart); elapsed >= time.Second {
+		b.measuredBps = uint64(float64(b.sentBytes*8) / elapsed.Seconds())
+		b.sentBytes = 0
+		b.windowStart = time.Now()
+	}
+}
+
+// Estimate returns the current usable bitrate: the smaller of the
+// browser's REMB ceiling and our own measured send rate, or whichever of
+// the two is non-zero. Nothing in the relay calls OnPacketSent, so the
+// measured rate stays 0 and the estimate is the latest REMB value.
+func (b *bitrateEstimator) Estimate() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.rembBps == 0:
+		return b.measuredBps
+	case b.measuredBps == 0:
+		return b.rembBps
+	case b.rembBps < b.measuredBps:
+		return b.rembBps
+	default:
+		return b.measuredBps
+	}
+}
+
+// simulcastLayer is one named encoding (RID) of a simulcast publish, along
+// with the minimum bitrate a receiver needs before it's a candidate layer.
+type simulcastLayer struct {
+	rid    string
+	minBps uint64
+}
+
+// simulcastLadder is ordered high to low quality. Forwarding layer choice
+// walks it from the first entry looking for the highest layer the estimate
+// can afford.
+var simulcastLadder = []simulcastLayer{
+	{rid: "f", minBps: 1_200_000}, // full
+	{rid: "h", minBps: 500_000},   // half
+	{rid: "q", minBps: 0},         // quarter, always affordable
+}
+
+// chooseLayer picks the best affordable RID for a given bitrate estimate
+// out of the layers the publisher actually has tracks for.
+func chooseLayer(estimateBps uint64, available map[string]*webrtc.TrackLocalStaticRTP) string {
+	for _, layer := range simulcastLadder {
+		if _, ok := available[layer.rid]; ok && estimateBps >= layer.minBps {
+			return layer.rid
+		}
+	}
+	return ""
+}
+
 // =============================================================================
 // OPTIMIZED: Broadcast with minimal lock time
 // =============================================================================
@@ -162,162 +887,667 @@ func (s *Server) BroadcastTimestamp(msgJSON string) {
 	atomic.AddUint64(&s.timestampCount, 1)
 }
 
-// =============================================================================
-// WebSocket Handler (Python Sender)
-// =============================================================================
+// forwardReceiverRTCP inspects RTCP read off a receiver's RTPSender,
+// counts the PLI/NACK packets on receiver for /metrics, serves any
+// TransportLayerNack it can out of streamID's packet cache, and relays the
+// packet types that matter for upstream adaptation/recovery (REMB for
+// bandwidth estimates, NACK for loss recovery, PLI for keyframe requests)
+// back to the Python sender's PeerConnection, so a struggling receiver can
+// influence what the sender does next.
+func (s *Server) forwardReceiverRTCP(receiver *ReceiverClient, streamID string, buf []byte) {
+	packets, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		return
+	}
 
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	log.Println("📡 Python sender connecting...")
+	for _, pkt := range packets {
+		switch p := pkt.(type) {
+		case *rtcp.PictureLossIndication:
+			atomic.AddUint64(&receiver.PLICount, 1)
+		case *rtcp.TransportLayerNack:
+			atomic.AddUint64(&receiver.NACKCount, 1)
+			s.serveNACKFromCache(streamID, receiver, p)
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			receiver.Estimator.OnREMB(uint64(p.Bitrate))
+			s.maybeScheduleLayerSwitch(receiver, streamID)
+		}
+	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade failed:", err)
+	s.mu.Lock()
+	senderPC := s.senderPC
+	s.mu.Unlock()
+	if senderPC == nil {
 		return
 	}
-	defer conn.Close()
 
-	conn.SetReadDeadline(time.Now().Add(120 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(120 * time.Second))
-		return nil
-	})
+	for _, pkt := range packets {
+		switch pkt.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate, *rtcp.TransportLayerNack, *rtcp.PictureLossIndication:
+			if err := senderPC.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+				log.Printf("Failed to forward RTCP to sender: %v", err)
+			}
+		}
+	}
+}
 
-	// Ping ticker
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
+// serveNACKFromCache answers receiver's TransportLayerNack out of the
+// packet cache for whichever simulcast layer of streamID it's actually
+// subscribed to (receiver.currentLayer), writing recovered packets back
+// onto that layer's shared local track - TrackLocalStaticRTP.WriteRTP
+// re-stamps the SSRC/PT per receiver, so no manual rewriting is needed
+// here. Comparing nack.MediaSSRC against the upstream SSRC doesn't work:
+// pion assigns each RTPSender its own random outbound SSRC at AddTrack
+// time, so a downstream nack never carries the upstream value. Keying the
+// lookup by the receiver's own layer instead sidesteps that entirely.
+func (s *Server) serveNACKFromCache(streamID string, receiver *ReceiverClient, nack *rtcp.TransportLayerNack) {
+	receiver.layerMu.Lock()
+	rid := receiver.currentLayer[streamID]
+	receiver.layerMu.Unlock()
+
+	s.streamsMu.RLock()
+	track := s.streamLayers[streamID][rid]
+	cache := s.videoCaches[streamID][rid]
+	s.streamsMu.RUnlock()
+	if track == nil || cache == nil {
+		return
+	}
+
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			pkt, ok := cache.Get(seq)
+			if !ok {
+				continue
+			}
+			if err := track.WriteRTP(pkt); err != nil && err != io.ErrClosedPipe {
+				log.Printf("Stream %q: failed to retransmit seq %d: %v", streamID, seq, err)
 			}
 		}
-	}()
+	}
+}
 
-	log.Println("✓ Sender WebSocket connected")
+// selectLayerForReceiver looks up streamID's layers in s.streamLayers and
+// picks the one receiver's bandwidth estimate can currently afford, falling
+// back to s.videoTracks[streamID] if that stream isn't simulcasting. On a
+// layer pick it records the choice in receiver.currentLayer[streamID]. It
+// doesn't hot-swap the track itself: its caller, addSubscription, adds the
+// returned track for a stream the receiver isn't subscribed to yet, and
+// later layer switches go through promotePendingReceivers.
+func (s *Server) selectLayerForReceiver(streamID string, receiver *ReceiverClient) *webrtc.TrackLocalStaticRTP {
+	s.streamsMu.RLock()
+	layers := s.streamLayers[streamID]
+	fallback := s.videoTracks[streamID]
+	s.streamsMu.RUnlock()
+
+	if len(layers) <= 1 {
+		return fallback
+	}
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+	rid := chooseLayer(receiver.Estimator.Estimate(), layers)
+	if rid == "" {
+		return fallback
 	}
 
-	pc, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		log.Println("PeerConnection failed:", err)
+	receiver.layerMu.Lock()
+	receiver.currentLayer[streamID] = rid
+	receiver.layerMu.Unlock()
+	return layers[rid]
+}
+
+// maybeScheduleLayerSwitch folds a receiver's updated bandwidth estimate
+// into a desired simulcast layer for streamID. It doesn't hot-swap the
+// track itself - that only happens once the target layer's next keyframe
+// arrives, in promotePendingReceivers, so the new layer's decoder starts
+// clean instead of picking up mid-GOP.
+func (s *Server) maybeScheduleLayerSwitch(receiver *ReceiverClient, streamID string) {
+	s.streamsMu.RLock()
+	layers := s.streamLayers[streamID]
+	s.streamsMu.RUnlock()
+	if len(layers) <= 1 {
 		return
 	}
-	defer pc.Close()
 
-	s.mu.Lock()
-	s.senderPC = pc
-	s.senderConnected = true
-	s.mu.Unlock()
+	rid := chooseLayer(receiver.Estimator.Estimate(), layers)
+	if rid == "" {
+		return
+	}
 
-	hasKeyframe := false
-	keyframeMu := &sync.Mutex{}
+	receiver.layerMu.Lock()
+	defer receiver.layerMu.Unlock()
+	if receiver.currentLayer[streamID] == rid {
+		delete(receiver.pendingLayer, streamID)
+		return
+	}
+	receiver.pendingLayer[streamID] = rid
+}
 
-	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("📹 Track: %s %s", track.Kind(), track.Codec().MimeType)
-
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			localTrack, err := webrtc.NewTrackLocalStaticRTP(
-				webrtc.RTPCodecCapability{
-					MimeType:    webrtc.MimeTypeH264,
-					ClockRate:   90000,
-					SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-				},
-				"video", "stream",
-			)
-			if err != nil {
-				log.Println("Track create failed:", err)
-				return
-			}
+// promotePendingReceivers hot-swaps every receiver whose bandwidth estimate
+// called for streamID's rid layer, now that rid's next keyframe has
+// arrived on track.
+func (s *Server) promotePendingReceivers(streamID, rid string, track *webrtc.TrackLocalStaticRTP) {
+	s.receiversMu.RLock()
+	receivers := make([]*ReceiverClient, 0, len(s.receivers))
+	for _, r := range s.receivers {
+		receivers = append(receivers, r)
+	}
+	s.receiversMu.RUnlock()
 
-			s.mu.Lock()
-			s.videoTrack = localTrack
-			s.mu.Unlock()
+	for _, receiver := range receivers {
+		receiver.layerMu.Lock()
+		want, pending := receiver.pendingLayer[streamID]
+		receiver.layerMu.Unlock()
+		if !pending || want != rid {
+			continue
+		}
 
-			log.Println("✓ Local H264 track created")
+		receiver.subsMu.Lock()
+		sender, subscribed := receiver.Subscriptions[streamID]
+		receiver.subsMu.Unlock()
+		if !subscribed {
+			continue
+		}
 
-			// Add to existing receivers
-			s.receiversMu.RLock()
-			for id, r := range s.receivers {
-				if r.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-					if _, err := r.PC.AddTrack(localTrack); err != nil {
-						log.Printf("Add track to %s failed: %v", id, err)
-					}
-				}
-			}
-			s.receiversMu.RUnlock()
+		if err := receiver.PC.RemoveTrack(sender); err != nil {
+			log.Printf("Receiver %s: failed to remove track for layer switch: %v", receiver.ID, err)
+			continue
+		}
+		newSender, err := receiver.PC.AddTrack(track)
+		if err != nil {
+			log.Printf("Receiver %s: failed to add track for layer switch: %v", receiver.ID, err)
+			continue
+		}
 
-			// Request keyframe
-			go func() {
-				time.Sleep(500 * time.Millisecond)
-				pc.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
-				})
-			}()
+		receiver.subsMu.Lock()
+		receiver.Subscriptions[streamID] = newSender
+		receiver.subsMu.Unlock()
 
-			// Periodic keyframe requests
-			go func() {
-				ticker := time.NewTicker(3 * time.Second)
-				defer ticker.Stop()
-				for range ticker.C {
-					keyframeMu.Lock()
-					need := !hasKeyframe
-					keyframeMu.Unlock()
-					if need && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
-						pc.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
-						})
-					}
+		receiver.layerMu.Lock()
+		receiver.currentLayer[streamID] = rid
+		delete(receiver.pendingLayer, streamID)
+		receiver.layerMu.Unlock()
+
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := newSender.Read(buf)
+				if err != nil {
+					return
 				}
-			}()
+				s.forwardReceiverRTCP(receiver, streamID, buf[:n])
+			}
+		}()
 
-			// Forward RTP
-			go func() {
-				count := 0
-				for {
-					pkt, _, err := track.ReadRTP()
-					if err != nil {
-						if err != io.EOF {
-							log.Printf("RTP read error: %v", err)
-						}
-						return
-					}
-					count++
-
-					// Keyframe detection
-					if len(pkt.Payload) > 0 {
-						nalType := pkt.Payload[0] & 0x1F
-						if nalType == 5 || nalType == 7 || nalType == 8 {
-							keyframeMu.Lock()
-							if !hasKeyframe {
-								log.Printf("✓ First keyframe at packet #%d", count)
-								hasKeyframe = true
-							}
-							keyframeMu.Unlock()
-						}
-					}
+		s.renegotiate(receiver)
+		log.Printf("Receiver %s: switched stream %q to layer %q", receiver.ID, streamID, rid)
+	}
+}
 
-					if count%1000 == 0 {
-						log.Printf("📦 %d H264 packets forwarded", count)
-					}
+// runPLIScheduler periodically asks the sender for a fresh keyframe on
+// every active stream so receivers recover from loss even without an
+// explicit NACK/PLI round trip. It's a no-op while there are zero
+// receivers and simply resumes sending on the first tick after one
+// connects, rather than tracking a separate pause/resume signal.
+func (s *Server) runPLIScheduler() {
+	ticker := time.NewTicker(s.PLI)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.receiversMu.RLock()
+		numReceivers := len(s.receivers)
+		s.receiversMu.RUnlock()
+		if numReceivers == 0 {
+			continue
+		}
 
-					s.mu.Lock()
-					if s.videoTrack != nil {
-						s.videoTrack.WriteRTP(pkt)
-					}
-					s.mu.Unlock()
+		s.mu.Lock()
+		senderPC := s.senderPC
+		s.mu.Unlock()
+		if senderPC == nil {
+			continue
+		}
+
+		s.streamsMu.RLock()
+		var ssrcs []webrtc.SSRC
+		for _, layers := range s.streamSSRC {
+			for _, ssrc := range layers {
+				ssrcs = append(ssrcs, ssrc)
+			}
+		}
+		s.streamsMu.RUnlock()
+
+		for _, ssrc := range ssrcs {
+			senderPC.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}})
+			s.recordKeyframeRequest(ssrc)
+		}
+	}
+}
+
+// addSubscription adds streamID's current best-layer track to receiver's
+// PeerConnection and wires its RTCP feedback, the same way regardless of
+// whether the caller is the legacy DataChannel subscribe flow or
+// handleOffer's initial offer/answer. It consults the room rather than
+// videoTracks directly, since the room is what every ingestion path now
+// registers its stream with (see forwardSenderVideoTrack). Callers are
+// responsible for renegotiating afterward if needed.
+func (s *Server) addSubscription(receiver *ReceiverClient, streamID string) bool {
+	if _, err := s.room.Subscribe(streamID); err != nil {
+		log.Printf("Subscribe: %v", err)
+		return false
+	}
+
+	track := s.selectLayerForReceiver(streamID, receiver)
+	if track == nil {
+		log.Printf("Subscribe: no track available for stream %q", streamID)
+		return false
+	}
+
+	sender, err := receiver.PC.AddTrack(track)
+	if err != nil {
+		log.Printf("Subscribe: failed to add stream %q for %s: %v", streamID, receiver.ID, err)
+		return false
+	}
+
+	receiver.subsMu.Lock()
+	receiver.Subscriptions[streamID] = sender
+	receiver.subsMu.Unlock()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := sender.Read(buf)
+			if err != nil {
+				return
+			}
+			s.forwardReceiverRTCP(receiver, streamID, buf[:n])
+		}
+	}()
+
+	return true
+}
+
+// subscribeStreams adds a transceiver for each stream ID the receiver
+// doesn't already have (unknown IDs are skipped, since the sender for that
+// camera may not have connected yet), then renegotiates.
+func (s *Server) subscribeStreams(receiver *ReceiverClient, streams []string) {
+	added := false
+
+	for _, streamID := range streams {
+		receiver.subsMu.Lock()
+		_, already := receiver.Subscriptions[streamID]
+		receiver.subsMu.Unlock()
+		if already {
+			continue
+		}
+
+		if s.addSubscription(receiver, streamID) {
+			added = true
+		}
+	}
+
+	if added {
+		s.renegotiate(receiver)
+	}
+}
+
+// unsubscribeStreams removes the transceiver for each stream ID the
+// receiver currently has, then renegotiates.
+func (s *Server) unsubscribeStreams(receiver *ReceiverClient, streams []string) {
+	removed := false
+
+	for _, streamID := range streams {
+		receiver.subsMu.Lock()
+		sender, ok := receiver.Subscriptions[streamID]
+		if ok {
+			delete(receiver.Subscriptions, streamID)
+		}
+		receiver.subsMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if err := receiver.PC.RemoveTrack(sender); err != nil {
+			log.Printf("Unsubscribe: failed to remove stream %q for %s: %v", streamID, receiver.ID, err)
+			continue
+		}
+
+		receiver.layerMu.Lock()
+		delete(receiver.currentLayer, streamID)
+		delete(receiver.pendingLayer, streamID)
+		receiver.layerMu.Unlock()
+
+		removed = true
+	}
+
+	if removed {
+		s.renegotiate(receiver)
+	}
+}
+
+// renegotiate creates a fresh offer reflecting the receiver's current set
+// of transceivers and pushes it over the "timestamps" DataChannel; the
+// browser is expected to answer back with an "answer" message on the same
+// channel, completing the exchange in dc.OnMessage.
+func (s *Server) renegotiate(receiver *ReceiverClient) {
+	offer, err := receiver.PC.CreateOffer(nil)
+	if err != nil {
+		log.Printf("Renegotiation: failed to create offer for %s: %v", receiver.ID, err)
+		return
+	}
+	if err := receiver.PC.SetLocalDescription(offer); err != nil {
+		log.Printf("Renegotiation: failed to set local description for %s: %v", receiver.ID, err)
+		return
+	}
+
+	payload, err := json.Marshal(SignalMessage{Type: "offer", SDP: offer.SDP})
+	if err != nil {
+		return
+	}
+	receiver.SendTimestamp(string(payload))
+}
+
+// attachSenderTrackHandler wires up the OnTrack forwarding behavior shared
+// by the legacy WebSocket sender path, the WHIP ingest path, and named
+// streams subscribed to individually via subscribeStreams. For
+// defaultStreamID it also keeps the old behavior of auto-adding the track
+// to every connected receiver, since that's the single-camera flow
+// receivers never explicitly subscribe to. Named streams instead wait for
+// an explicit subscribe over the DataChannel, so one browser watching a
+// wall of cameras doesn't get every publish.
+func (s *Server) attachSenderTrackHandler(pc *webrtc.PeerConnection, streamID string) {
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("📹 Track: %s %s (stream %q)", track.Kind(), track.Codec().MimeType, streamID)
+
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			s.forwardSenderAudioTrack(pc, track, streamID)
+			return
+		}
+
+		s.forwardSenderVideoTrack(pc, track, streamID)
+	})
+}
+
+// forwardSenderVideoTrack builds a local track matching whatever video
+// codec the sender actually negotiated (rather than assuming H264), wires
+// it into the stream/default-track bookkeeping, and relays RTP into it
+// while watching for the first keyframe to arrive.
+func (s *Server) forwardSenderVideoTrack(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, streamID string) {
+	rid := track.RID()
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, "video", streamID)
+	if err != nil {
+		log.Println("Track create failed:", err)
+		return
+	}
+
+	cache := newPacketCache(defaultCacheSize)
+	jitter := newJitterEstimator(track.Codec().ClockRate)
+
+	s.streamsMu.Lock()
+	if s.streamLayers[streamID] == nil {
+		s.streamLayers[streamID] = make(map[string]*webrtc.TrackLocalStaticRTP)
+	}
+	s.streamLayers[streamID][rid] = localTrack
+	// videoTracks holds the "f" layer once it arrives, else the first
+	// layer to arrive (or the only one), so callers that don't care about
+	// simulcast keep working unmodified.
+	if rid == "" || rid == simulcastLadder[0].rid || s.videoTracks[streamID] == nil {
+		s.videoTracks[streamID] = localTrack
+	}
+	if s.streamSSRC[streamID] == nil {
+		s.streamSSRC[streamID] = make(map[string]webrtc.SSRC)
+	}
+	s.streamSSRC[streamID][rid] = track.SSRC()
+	if s.videoCaches[streamID] == nil {
+		s.videoCaches[streamID] = make(map[string]*packetCache)
+	}
+	s.videoCaches[streamID][rid] = cache
+	s.videoJitter[streamID] = jitter
+	topTrack := s.videoTracks[streamID]
+	s.streamsMu.Unlock()
+
+	// Register streamID as a room producer here, rather than in each of
+	// this method's callers (the legacy /ws sender, WHIP ingest, ...), so
+	// every ingestion path makes its stream visible to addSubscription the
+	// same way. The owning peer is synthetic and never receives anything -
+	// it exists only so Room.Publish has a PeerID to attribute the track
+	// to and Room.Leave can clean it up if the stream is ever re-published
+	// by someone else.
+	if rid == "" || rid == simulcastLadder[0].rid {
+		publisherID := "publisher:" + streamID
+		s.room.Join(&signaling.Peer{ID: publisherID, Send: func(signaling.Message) error { return nil }})
+		if _, err := s.room.Publish(publisherID, streamID, "video"); err != nil {
+			log.Printf("Room: failed to publish stream %q: %v", streamID, err)
+		}
+	}
+
+	if streamID == defaultStreamID {
+		s.mu.Lock()
+		s.videoTrack = topTrack
+		s.mu.Unlock()
+
+		// Add to existing receivers
+		s.receiversMu.RLock()
+		for id, r := range s.receivers {
+			if r.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+				if _, err := r.PC.AddTrack(localTrack); err != nil {
+					log.Printf("Add track to %s failed: %v", id, err)
 				}
-			}()
+			}
+		}
+		s.receiversMu.RUnlock()
+	}
+
+	log.Printf("✓ Local %s track created for stream %q (layer %q)", track.Codec().MimeType, streamID, rid)
+
+	hasKeyframe := false
+	keyframeMu := &sync.Mutex{}
+	detector := keyFrameDetectorFor(track.Codec().MimeType)
+	var firSeqno uint8
+
+	// requestKeyframe sends both PLI and FIR, since not every encoder on the
+	// other end honors PLI; firSeqno must increment on every FIR per RFC 5104.
+	requestKeyframe := func() {
+		keyframeMu.Lock()
+		firSeqno++
+		seq := firSeqno
+		keyframeMu.Unlock()
+
+		pc.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+			&rtcp.FullIntraRequest{
+				FIR: []rtcp.FIREntry{{SSRC: uint32(track.SSRC()), SequenceNumber: seq}},
+			},
+		})
+		s.recordKeyframeRequest(track.SSRC())
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		requestKeyframe()
+	}()
+
+	// Periodic keyframe requests, rate-limited to once per s.PLI so a slow
+	// encoder doesn't get flooded while we wait for its first keyframe.
+	go func() {
+		ticker := time.NewTicker(s.PLI)
+		defer ticker.Stop()
+		for range ticker.C {
+			keyframeMu.Lock()
+			need := !hasKeyframe
+			keyframeMu.Unlock()
+			if need && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+				requestKeyframe()
+			}
+		}
+	}()
+
+	// Forward RTP
+	go func() {
+		count := 0
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("RTP read error: %v", err)
+				}
+				return
+			}
+			count++
+
+			cache.Store(pkt)
+			jitter.Update(pkt.Timestamp, time.Now())
+
+			isKeyframe := detector != nil && detector.IsKeyFrame(pkt.Payload)
+			if isKeyframe {
+				keyframeMu.Lock()
+				if !hasKeyframe {
+					log.Printf("✓ First keyframe at packet #%d", count)
+					hasKeyframe = true
+				}
+				keyframeMu.Unlock()
+
+				// Hot-swap any receiver waiting on this layer now that it
+				// has a clean entry point to decode from.
+				s.promotePendingReceivers(streamID, rid, localTrack)
+				s.observeKeyframeArrival(track.SSRC())
+			}
+
+			if s.recorder != nil {
+				s.recorder.WriteVideo(streamID, track.Codec().MimeType, pkt, isKeyframe)
+			}
+
+			s.recordRTPForwarded(track.SSRC(), pkt)
+
+			if count%1000 == 0 {
+				log.Printf("📦 %d %s packets forwarded (stream %q)", count, track.Codec().MimeType, streamID)
+			}
+
+			localTrack.WriteRTP(pkt)
+		}
+	}()
+}
+
+// forwardSenderAudioTrack mirrors forwardSenderVideoTrack for the sender's
+// Opus track, so receivers get audio alongside video instead of video-only.
+func (s *Server) forwardSenderAudioTrack(pc *webrtc.PeerConnection, track *webrtc.TrackRemote, streamID string) {
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, "audio", streamID)
+	if err != nil {
+		log.Println("Audio track create failed:", err)
+		return
+	}
+
+	s.streamsMu.Lock()
+	s.audioTracks[streamID] = localTrack
+	s.streamsMu.Unlock()
+
+	if streamID == defaultStreamID {
+		s.mu.Lock()
+		s.audioTrack = localTrack
+		s.mu.Unlock()
+
+		s.receiversMu.RLock()
+		for id, r := range s.receivers {
+			if r.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+				if _, err := r.PC.AddTrack(localTrack); err != nil {
+					log.Printf("Add audio track to %s failed: %v", id, err)
+				}
+			}
 		}
+		s.receiversMu.RUnlock()
+	}
+
+	log.Printf("✓ Local %s track created for stream %q", track.Codec().MimeType, streamID)
+
+	clockRate := track.Codec().ClockRate
+
+	go func() {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Audio RTP read error: %v", err)
+				}
+				return
+			}
+
+			if s.recorder != nil {
+				s.recorder.WriteAudio(streamID, pkt, clockRate)
+			}
+
+			s.recordRTPForwarded(track.SSRC(), pkt)
+
+			localTrack.WriteRTP(pkt)
+		}
+	}()
+}
+
+// =============================================================================
+// WebSocket Handler (Python Sender)
+// =============================================================================
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	log.Println("📡 Python sender connecting...")
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(120 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(120 * time.Second))
+		return nil
 	})
 
+	// Ping ticker
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}()
+
+	log.Println("✓ Sender WebSocket connected")
+
+	pc, err := s.newPeerConnection()
+	if err != nil {
+		log.Println("PeerConnection failed:", err)
+		return
+	}
+	defer pc.Close()
+
+	s.mu.Lock()
+	s.senderPC = pc
+	s.senderConnected = true
+	s.mu.Unlock()
+
+	streamID := r.URL.Query().Get("stream")
+	if streamID == "" {
+		streamID = defaultStreamID
+	}
+	s.attachSenderTrackHandler(pc, streamID)
+
+	// peerID joins the room purely so this sender shows up in Room.Join's
+	// peer list and can receive future room notifications; the actual
+	// stream producer is registered separately, inside
+	// forwardSenderVideoTrack, once its track exists.
+	peerID := fmt.Sprintf("sender:%s", streamID)
+	peer := &signaling.Peer{
+		ID: peerID,
+		Send: func(msg signaling.Message) error {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			return conn.WriteJSON(msg)
+		},
+	}
+
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
+		s.recordICECandidate(c)
 		cj := c.ToJSON()
 		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 		conn.WriteJSON(SignalMessage{Type: "ice-candidate", Candidate: &cj})
@@ -325,12 +1555,18 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("Sender state: %s", state)
+		s.setPeerConnectionState(peerID, "sender", state)
 		if state == webrtc.PeerConnectionStateConnected {
 			log.Println("✓ SENDER CONNECTED")
+			s.recordNominatedCandidateFromStats(pc)
 		}
 	})
 
-	// Message loop
+	// Message loop. Requests (join/publish/close) use the protoo-style
+	// {request, id, method, data} envelope and get a correlated {response,
+	// id, ok, data/errorReason} reply; everything else (ICE trickle, the
+	// ping keepalive, and the timestamp relay) keeps its old bespoke
+	// {type, ...} shape since none of that is room signaling.
 	for {
 		conn.SetReadDeadline(time.Now().Add(120 * time.Second))
 		_, raw, err := conn.ReadMessage()
@@ -339,26 +1575,55 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		var base struct{ Type string `json:"type"` }
-		if json.Unmarshal(raw, &base) != nil {
+		var probe struct {
+			Type    string `json:"type"`
+			Request bool   `json:"request"`
+		}
+		if json.Unmarshal(raw, &probe) != nil {
 			continue
 		}
 
-		switch base.Type {
-		case "offer":
-			var msg SignalMessage
-			json.Unmarshal(raw, &msg)
+		if probe.Request {
+			var req signaling.Message
+			json.Unmarshal(raw, &req)
 
-			offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.SDP}
-			pc.SetRemoteDescription(offer)
+			switch req.Method {
+			case "join":
+				producers := s.room.Join(peer)
+				peer.Send(signaling.NewResponse(req.ID, producers))
 
-			answer, _ := pc.CreateAnswer(nil)
-			pc.SetLocalDescription(answer)
+			case "publish":
+				var data struct {
+					SDP string `json:"sdp"`
+				}
+				json.Unmarshal(req.Data, &data)
 
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			conn.WriteJSON(SignalMessage{Type: "answer", SDP: answer.SDP})
-			log.Println("✓ Answer sent")
+				offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: data.SDP}
+				if err := pc.SetRemoteDescription(offer); err != nil {
+					peer.Send(signaling.NewErrorResponse(req.ID, err.Error()))
+					continue
+				}
+				answer, err := pc.CreateAnswer(nil)
+				if err != nil {
+					peer.Send(signaling.NewErrorResponse(req.ID, err.Error()))
+					continue
+				}
+				pc.SetLocalDescription(answer)
 
+				peer.Send(signaling.NewResponse(req.ID, map[string]string{"sdp": answer.SDP}))
+				log.Println("✓ Answer sent")
+
+			case "close":
+				peer.Send(signaling.NewResponse(req.ID, nil))
+				conn.Close()
+
+			default:
+				peer.Send(signaling.NewErrorResponse(req.ID, fmt.Sprintf("unknown method %q", req.Method)))
+			}
+			continue
+		}
+
+		switch probe.Type {
 		case "ice-candidate":
 			var msg SignalMessage
 			json.Unmarshal(raw, &msg)
@@ -392,10 +1657,13 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	s.room.Leave(peerID)
+
 	s.mu.Lock()
 	s.senderConnected = false
 	s.senderPC = nil
 	s.videoTrack = nil
+	s.audioTrack = nil
 	s.mu.Unlock()
 
 	log.Println("Sender disconnected")
@@ -421,12 +1689,11 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	s.mu.Lock()
-	connected := s.senderConnected
-	track := s.videoTrack
-	s.mu.Unlock()
-
-	if !connected || track == nil {
+	// This is a compatibility shim for browsers that still POST an offer
+	// instead of speaking the /ws protoo protocol: it does the same room
+	// lookup addSubscription does below, just early enough to answer with
+	// 503 instead of creating a PeerConnection for nothing.
+	if _, err := s.room.Subscribe(defaultStreamID); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Video not ready"})
@@ -439,13 +1706,7 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
-	}
-
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := s.newPeerConnection()
 	if err != nil {
 		http.Error(w, "PeerConnection failed", http.StatusInternalServerError)
 		return
@@ -454,6 +1715,23 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	id := fmt.Sprintf("browser-%d", time.Now().UnixNano())
 	receiver := NewReceiverClient(id, pc)
 
+	// Trickle our candidates to the browser as they're discovered instead
+	// of making it wait for handleOffer's response; the "timestamps"
+	// DataChannel carries them since there's no other open channel back to
+	// the browser on this HTTP-only signaling path.
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		s.recordICECandidate(c)
+		cj := c.ToJSON()
+		payload, err := json.Marshal(SignalMessage{Type: "candidate", Candidate: &cj})
+		if err != nil {
+			return
+		}
+		receiver.SendTimestamp(string(payload))
+	})
+
 	// Handle DataChannel from browser
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
 		log.Printf("📡 DataChannel '%s' from %s", dc.Label(), id)
@@ -466,19 +1744,46 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 			})
 
 			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-				var ts TimestampMessage
-				if json.Unmarshal(msg.Data, &ts) != nil {
+				var base struct{ Type string `json:"type"` }
+				if json.Unmarshal(msg.Data, &base) != nil {
 					return
 				}
 
-				if ts.Type == "ping" {
+				switch base.Type {
+				case "ping":
+					var ts TimestampMessage
+					json.Unmarshal(msg.Data, &ts)
+					serverTime := float64(time.Now().UnixNano()) / 1e6
+					if ts.ClientTime > 0 {
+						receiver.LatencyHist.Observe(serverTime - ts.ClientTime)
+					}
 					pong := TimestampMessage{
 						Type:       "pong",
 						ClientTime: ts.ClientTime,
-						ServerTime: float64(time.Now().UnixNano()) / 1e6,
+						ServerTime: serverTime,
 					}
 					data, _ := json.Marshal(pong)
 					dc.SendText(string(data))
+
+				case "subscribe":
+					var sub SubscribeMessage
+					json.Unmarshal(msg.Data, &sub)
+					s.subscribeStreams(receiver, sub.Streams)
+
+				case "unsubscribe":
+					var sub SubscribeMessage
+					json.Unmarshal(msg.Data, &sub)
+					s.unsubscribeStreams(receiver, sub.Streams)
+
+				case "answer":
+					var sig SignalMessage
+					json.Unmarshal(msg.Data, &sig)
+					if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+						Type: webrtc.SDPTypeAnswer,
+						SDP:  sig.SDP,
+					}); err != nil {
+						log.Printf("Renegotiation: failed to apply answer from %s: %v", id, err)
+					}
 				}
 			})
 		}
@@ -488,24 +1793,41 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 	s.receivers[id] = receiver
 	s.receiversMu.Unlock()
 
+	s.room.Join(&signaling.Peer{
+		ID: id,
+		Send: func(msg signaling.Message) error {
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			receiver.SendTimestamp(string(payload))
+			return nil
+		},
+	})
+
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("Browser %s: %s", id, state)
+		s.setPeerConnectionState(id, "receiver", state)
 
 		if state == webrtc.PeerConnectionStateConnected {
 			log.Printf("✓ BROWSER %s CONNECTED", id)
+			s.recordNominatedCandidateFromStats(pc)
 
 			// Request keyframe
 			if s.senderPC != nil {
 				for _, recv := range s.senderPC.GetReceivers() {
 					if recv.Track() != nil && recv.Track().Kind() == webrtc.RTPCodecTypeVideo {
+						ssrc := recv.Track().SSRC()
 						s.senderPC.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{MediaSSRC: uint32(recv.Track().SSRC())},
+							&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)},
 						})
+						s.recordKeyframeRequest(ssrc)
 						break
 					}
 				}
 			}
 		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.room.Leave(id)
 			s.receiversMu.Lock()
 			if r, ok := s.receivers[id]; ok {
 				r.Close()
@@ -515,39 +1837,407 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		}
 	})
 
-	// Add video track
-	sender, _ := pc.AddTrack(track)
-	go func() {
-		buf := make([]byte, 1500)
-		for {
-			if _, _, err := sender.Read(buf); err != nil {
-				return
-			}
-		}
-	}()
+	// Subscribe to the default stream through the same path named-stream
+	// subscribers use, rather than hand-rolling AddTrack here.
+	if !s.addSubscription(receiver, defaultStreamID) {
+		http.Error(w, "Failed to add track", http.StatusInternalServerError)
+		return
+	}
+
+	// Add audio track alongside video, if the sender has published one.
+	s.mu.Lock()
+	audioTrack := s.audioTrack
+	s.mu.Unlock()
+	if audioTrack != nil {
+		if audioSender, err := pc.AddTrack(audioTrack); err != nil {
+			log.Printf("Add audio track to %s failed: %v", id, err)
+		} else {
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					n, _, err := audioSender.Read(buf)
+					if err != nil {
+						return
+					}
+					s.forwardReceiverRTCP(receiver, defaultStreamID, buf[:n])
+				}
+			}()
+		}
+	}
 
 	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP}
 	pc.SetRemoteDescription(offer)
 
 	answer, _ := pc.CreateAnswer(nil)
-
-	done := webrtc.GatheringCompletePromise(pc)
 	pc.SetLocalDescription(answer)
 
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
-	}
-
+	// Trickle ICE: return the answer right away instead of blocking on
+	// GatheringCompletePromise. Remaining candidates reach the browser over
+	// the DataChannel as OnICECandidate fires above.
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"sdp":  pc.LocalDescription().SDP,
 		"type": "answer",
+		"id":   id,
 	})
 
 	log.Printf("✓ Answer sent to %s", id)
 }
 
+// handleICECandidate lets a browser receiver trickle its own candidates in,
+// one POST per candidate, addressed by the same id handleOffer handed back
+// as the answer's implicit session (the id embedded in the URL path).
+func (s *Server) handleICECandidate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/ice/")
+
+	s.receiversMu.RLock()
+	receiver, ok := s.receivers[id]
+	s.receiversMu.RUnlock()
+
+	if !ok {
+		http.Error(w, "Unknown receiver", http.StatusNotFound)
+		return
+	}
+
+	var candidate webrtc.ICECandidateInit
+	if json.NewDecoder(r.Body).Decode(&candidate) != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := receiver.PC.AddICECandidate(candidate); err != nil {
+		log.Printf("Failed to add trickled candidate from %s: %v", id, err)
+		http.Error(w, "Failed to add ICE candidate", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWHIP implements the ingest side of WHIP (WebRTC-HTTP Ingestion
+// Protocol): a POST of an `application/sdp` offer stands up the sender
+// PeerConnection and returns the answer SDP along with a Location header
+// pointing at the new resource, so OBS/GStreamer-style WHIP clients can
+// publish without going through the Python sender's WebSocket handshake.
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offerSDP, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer body", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.newPeerConnection()
+	if err != nil {
+		log.Printf("WHIP: failed to create PeerConnection: %v", err)
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.senderPC = pc
+	s.senderConnected = true
+	s.mu.Unlock()
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) { s.recordICECandidate(c) })
+
+	streamID := r.URL.Query().Get("stream")
+	if streamID == "" {
+		streamID = defaultStreamID
+	}
+	s.attachSenderTrackHandler(pc, streamID)
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offerSDP),
+	}); err != nil {
+		log.Printf("WHIP: failed to set remote description: %v", err)
+		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("WHIP: failed to create answer: %v", err)
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("WHIP: failed to set local description: %v", err)
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+		log.Println("WHIP: ICE gathering timeout")
+	}
+
+	resourceID := fmt.Sprintf("whip-%d", time.Now().UnixNano())
+	s.sessionsMu.Lock()
+	s.sessions[resourceID] = &WHIPSession{ID: resourceID, PC: pc}
+	s.sessionsMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		s.setPeerConnectionState(resourceID, "whip", state)
+		if state == webrtc.PeerConnectionStateConnected {
+			s.recordNominatedCandidateFromStats(pc)
+		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.mu.Lock()
+			s.senderConnected = false
+			s.senderPC = nil
+			s.videoTrack = nil
+			s.audioTrack = nil
+			s.mu.Unlock()
+			s.teardownSession(resourceID)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("✓ WHIP publisher connected (resource %s)", resourceID)
+}
+
+// handleWHEP implements the playback side of WHEP (WebRTC-HTTP Egress
+// Protocol), mirroring handleWHIP for subscribers: POST an offer, get an
+// answer SDP and a Location for the resulting resource back.
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.mu.Lock()
+	connected := s.senderConnected
+	track := s.videoTrack
+	s.mu.Unlock()
+
+	if !connected || track == nil {
+		http.Error(w, "Video not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	offerSDP, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read offer body", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.newPeerConnection()
+	if err != nil {
+		log.Printf("WHEP: failed to create PeerConnection: %v", err)
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	id := fmt.Sprintf("whep-%d", time.Now().UnixNano())
+	receiver := NewReceiverClient(id, pc)
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) { s.recordICECandidate(c) })
+
+	s.receiversMu.Lock()
+	s.receivers[id] = receiver
+	s.receiversMu.Unlock()
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		log.Printf("WHEP: failed to add track: %v", err)
+		http.Error(w, "Failed to add track", http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := sender.Read(buf)
+			if err != nil {
+				return
+			}
+			s.forwardReceiverRTCP(receiver, defaultStreamID, buf[:n])
+		}
+	}()
+
+	// Add audio track alongside video, if the sender has published one.
+	s.mu.Lock()
+	audioTrack := s.audioTrack
+	s.mu.Unlock()
+	if audioTrack != nil {
+		if audioSender, err := pc.AddTrack(audioTrack); err != nil {
+			log.Printf("WHEP: failed to add audio track: %v", err)
+		} else {
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					n, _, err := audioSender.Read(buf)
+					if err != nil {
+						return
+					}
+					s.forwardReceiverRTCP(receiver, defaultStreamID, buf[:n])
+				}
+			}()
+		}
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offerSDP),
+	}); err != nil {
+		log.Printf("WHEP: failed to set remote description: %v", err)
+		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("WHEP: failed to create answer: %v", err)
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("WHEP: failed to set local description: %v", err)
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(3 * time.Second):
+		log.Println("WHEP: ICE gathering timeout")
+	}
+
+	resourceID := fmt.Sprintf("whep-%d", time.Now().UnixNano())
+	s.sessionsMu.Lock()
+	s.sessions[resourceID] = &WHIPSession{ID: resourceID, PC: pc}
+	s.sessionsMu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("WHEP subscriber %s: %s", id, state)
+		s.setPeerConnectionState(id, "whep", state)
+		if state == webrtc.PeerConnectionStateConnected {
+			s.recordNominatedCandidateFromStats(pc)
+			if s.senderPC != nil {
+				for _, recv := range s.senderPC.GetReceivers() {
+					if recv.Track() != nil && recv.Track().Kind() == webrtc.RTPCodecTypeVideo {
+						ssrc := recv.Track().SSRC()
+						s.senderPC.WriteRTCP([]rtcp.Packet{
+							&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)},
+						})
+						s.recordKeyframeRequest(ssrc)
+						break
+					}
+				}
+			}
+		} else if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.receiversMu.Lock()
+			if r, ok := s.receivers[id]; ok {
+				r.Close()
+				delete(s.receivers, id)
+			}
+			s.receiversMu.Unlock()
+			s.teardownSession(resourceID)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(pc.LocalDescription().SDP))
+
+	log.Printf("✓ WHEP subscriber connected (resource %s)", resourceID)
+}
+
+// handleWHIPResource services DELETE (teardown) against a resource
+// previously created by handleWHIP or handleWHEP.
+func (s *Server) handleWHIPResource(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resourceID := strings.TrimPrefix(r.URL.Path, "/whip/")
+	resourceID = strings.TrimPrefix(resourceID, "/whep/")
+
+	s.sessionsMu.RLock()
+	session, ok := s.sessions[resourceID]
+	s.sessionsMu.RUnlock()
+
+	if !ok {
+		http.Error(w, "Unknown resource", http.StatusNotFound)
+		return
+	}
+
+	session.PC.Close()
+	s.teardownSession(resourceID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) teardownSession(resourceID string) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, resourceID)
+	s.sessionsMu.Unlock()
+}
+
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -556,18 +2246,258 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	n := len(s.receivers)
 	s.receiversMu.RUnlock()
 
+	s.streamsMu.RLock()
+	codec := "none"
+	if track, ok := s.videoTracks[defaultStreamID]; ok {
+		codec = track.Codec().MimeType
+	}
+	s.streamsMu.RUnlock()
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"sender_url":        "Python Sender",
 		"status":            s.senderConnected,
 		"num_receivers":     n,
-		"codec":             "H264",
+		"codec":             codec,
 		"latency_supported": true,
 	})
 }
 
+// receiverSnapshot is the point-in-time view of one receiver shared by
+// /metrics and /api/v1/receivers.
+type receiverSnapshot struct {
+	ID                 string  `json:"id"`
+	ICEConnectionState string  `json:"ice_connection_state"`
+	ConnectionState    string  `json:"connection_state"`
+	BytesSent          uint64  `json:"bytes_sent"`
+	PacketsSent        uint64  `json:"packets_sent"`
+	BitrateBps         float64 `json:"bitrate_bps"`
+	RTTMs              float64 `json:"rtt_ms"`
+	PLICount           uint64  `json:"pli_count"`
+	NACKCount          uint64  `json:"nack_count"`
+}
+
+// receiverSnapshots pulls connection state, traffic counters and RTT out of
+// each receiver's own GetStats() report, combines them with the PLI/NACK
+// counters forwardReceiverRTCP keeps, and turns the cumulative bytes-sent
+// counter into a current bitrate using the previous sample on the receiver.
+func (s *Server) receiverSnapshots() []receiverSnapshot {
+	s.receiversMu.RLock()
+	receivers := make([]*ReceiverClient, 0, len(s.receivers))
+	for _, r := range s.receivers {
+		receivers = append(receivers, r)
+	}
+	s.receiversMu.RUnlock()
+
+	now := time.Now()
+	snapshots := make([]receiverSnapshot, 0, len(receivers))
+	for _, r := range receivers {
+		var bytesSent, packetsSent uint64
+		var rttMs float64
+		for _, stat := range r.PC.GetStats() {
+			switch st := stat.(type) {
+			case webrtc.OutboundRTPStreamStats:
+				bytesSent += st.BytesSent
+				packetsSent += uint64(st.PacketsSent)
+			case webrtc.ICECandidatePairStats:
+				if st.Nominated {
+					rttMs = st.CurrentRoundTripTime * 1000
+				}
+			}
+		}
+
+		r.statsMu.Lock()
+		var bitrateBps float64
+		if !r.lastStatsAt.IsZero() {
+			if elapsed := now.Sub(r.lastStatsAt).Seconds(); elapsed > 0 && bytesSent >= r.lastBytesSent {
+				bitrateBps = float64(bytesSent-r.lastBytesSent) * 8 / elapsed
+			}
+		}
+		r.lastBytesSent = bytesSent
+		r.lastStatsAt = now
+		r.statsMu.Unlock()
+
+		snapshots = append(snapshots, receiverSnapshot{
+			ID:                 r.ID,
+			ICEConnectionState: r.PC.ICEConnectionState().String(),
+			ConnectionState:    r.PC.ConnectionState().String(),
+			BytesSent:          bytesSent,
+			PacketsSent:        packetsSent,
+			BitrateBps:         bitrateBps,
+			RTTMs:              rttMs,
+			PLICount:           atomic.LoadUint64(&r.PLICount),
+			NACKCount:          atomic.LoadUint64(&r.NACKCount),
+		})
+	}
+	return snapshots
+}
+
+// handleAPIReceivers returns the same per-receiver data as /metrics as
+// JSON, for dashboards that would rather not parse Prometheus text format.
+func (s *Server) handleAPIReceivers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(s.receiverSnapshots())
+}
+
+// handleMetrics exposes per-receiver connection/traffic stats and the
+// glass-to-glass latency histogram (sampled from the ping/pong exchange on
+// the "timestamps" DataChannel) in Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	s.receiversMu.RLock()
+	receivers := make([]*ReceiverClient, 0, len(s.receivers))
+	for _, rc := range s.receivers {
+		receivers = append(receivers, rc)
+	}
+	s.receiversMu.RUnlock()
+
+	snapshots := s.receiverSnapshots()
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_bytes_sent_total Bytes sent to the receiver's outbound RTP stream.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_bytes_sent_total counter")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_bytes_sent_total{receiver_id=%q} %d\n", snap.ID, snap.BytesSent)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_packets_sent_total Packets sent to the receiver's outbound RTP stream.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_packets_sent_total counter")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_packets_sent_total{receiver_id=%q} %d\n", snap.ID, snap.PacketsSent)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_bitrate_bps Current outbound bitrate to the receiver.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_bitrate_bps gauge")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_bitrate_bps{receiver_id=%q} %.2f\n", snap.ID, snap.BitrateBps)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_rtt_ms Round-trip time from the nominated ICE candidate pair.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_rtt_ms gauge")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_rtt_ms{receiver_id=%q} %.2f\n", snap.ID, snap.RTTMs)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_pli_total PLI requests received from the receiver.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_pli_total counter")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_pli_total{receiver_id=%q} %d\n", snap.ID, snap.PLICount)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_nack_total NACKs received from the receiver.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_nack_total counter")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_nack_total{receiver_id=%q} %d\n", snap.ID, snap.NACKCount)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_receiver_connection_state Connection state as labels; value is always 1.")
+	fmt.Fprintln(w, "# TYPE webrtc_receiver_connection_state gauge")
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "webrtc_receiver_connection_state{receiver_id=%q,ice_state=%q,state=%q} 1\n",
+			snap.ID, snap.ICEConnectionState, snap.ConnectionState)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_glass_to_glass_latency_ms Glass-to-glass latency samples from the ping/pong exchange, in milliseconds.")
+	fmt.Fprintln(w, "# TYPE webrtc_glass_to_glass_latency_ms histogram")
+	for _, rc := range receivers {
+		buckets, sum, count := rc.LatencyHist.Snapshot()
+		for i, bound := range latencyBucketsMs {
+			fmt.Fprintf(w, "webrtc_glass_to_glass_latency_ms_bucket{receiver_id=%q,le=%q} %d\n", rc.ID, fmt.Sprintf("%g", bound), buckets[i])
+		}
+		fmt.Fprintf(w, "webrtc_glass_to_glass_latency_ms_bucket{receiver_id=%q,le=\"+Inf\"} %d\n", rc.ID, count)
+		fmt.Fprintf(w, "webrtc_glass_to_glass_latency_ms_sum{receiver_id=%q} %.3f\n", rc.ID, sum)
+		fmt.Fprintf(w, "webrtc_glass_to_glass_latency_ms_count{receiver_id=%q} %d\n", rc.ID, count)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_peerconnections Current PeerConnections by role and state.")
+	fmt.Fprintln(w, "# TYPE webrtc_peerconnections gauge")
+	for label, n := range s.peerConnectionCounts() {
+		fmt.Fprintf(w, "webrtc_peerconnections{role=%q,state=%q} %d\n", label.role, label.state, n)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_ice_candidates_total ICE candidates gathered, by protocol, type, and whether they ended up on the nominated pair.")
+	fmt.Fprintln(w, "# TYPE webrtc_ice_candidates_total counter")
+	for label, n := range s.iceCandidateCounts() {
+		fmt.Fprintf(w, "webrtc_ice_candidates_total{protocol=%q,type=%q,used=%q} %d\n", label.protocol, label.typ, strconv.FormatBool(label.used), n)
+	}
+
+	packetsForwarded, bytesForwarded := s.rtpForwardedSnapshot()
+
+	fmt.Fprintln(w, "# HELP webrtc_rtp_packets_forwarded_total RTP packets forwarded from a sender's track to its receivers.")
+	fmt.Fprintln(w, "# TYPE webrtc_rtp_packets_forwarded_total counter")
+	for ssrc, n := range packetsForwarded {
+		fmt.Fprintf(w, "webrtc_rtp_packets_forwarded_total{ssrc=\"%d\"} %d\n", ssrc, n)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_rtp_bytes_forwarded_total RTP bytes forwarded from a sender's track to its receivers.")
+	fmt.Fprintln(w, "# TYPE webrtc_rtp_bytes_forwarded_total counter")
+	for ssrc, n := range bytesForwarded {
+		fmt.Fprintf(w, "webrtc_rtp_bytes_forwarded_total{ssrc=\"%d\"} %d\n", ssrc, n)
+	}
+
+	fmt.Fprintln(w, "# HELP webrtc_keyframe_request_total PLI/FIR keyframe requests sent upstream.")
+	fmt.Fprintln(w, "# TYPE webrtc_keyframe_request_total counter")
+	fmt.Fprintf(w, "webrtc_keyframe_request_total %d\n", atomic.LoadUint64(&s.keyframeRequests))
+
+	fmt.Fprintln(w, "# HELP webrtc_keyframe_latency_seconds Time from a keyframe request to the next keyframe actually arriving.")
+	fmt.Fprintln(w, "# TYPE webrtc_keyframe_latency_seconds histogram")
+	{
+		buckets, sumMs, count := s.keyframeLatencyHist.Snapshot()
+		for i, bound := range latencyBucketsMs {
+			fmt.Fprintf(w, "webrtc_keyframe_latency_seconds_bucket{le=%q} %d\n", fmt.Sprintf("%g", bound/1000), buckets[i])
+		}
+		fmt.Fprintf(w, "webrtc_keyframe_latency_seconds_bucket{le=\"+Inf\"} %d\n", count)
+		fmt.Fprintf(w, "webrtc_keyframe_latency_seconds_sum %.3f\n", sumMs/1000)
+		fmt.Fprintf(w, "webrtc_keyframe_latency_seconds_count %d\n", count)
+	}
+}
+
+// pliIntervalFromEnv reads the PLI_INTERVAL env var (seconds) and falls back
+// to defaultPLIInterval if it's unset or not a valid positive number.
+func pliIntervalFromEnv() time.Duration {
+	const defaultPLIInterval = 3 * time.Second
+	raw := os.Getenv("PLI_INTERVAL")
+	if raw == "" {
+		return defaultPLIInterval
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid PLI_INTERVAL %q, using default of %s", raw, defaultPLIInterval)
+		return defaultPLIInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// recordDirFromEnv reads the RECORD_DIR env var and falls back to
+// defaultRecordDir if it's unset.
+func recordDirFromEnv() string {
+	const defaultRecordDir = "./recordings"
+	if dir := os.Getenv("RECORD_DIR"); dir != "" {
+		return dir
+	}
+	return defaultRecordDir
+}
+
+// recordSegmentFromEnv reads the RECORD_SEGMENT_SECONDS env var and falls
+// back to defaultRecordSegment if it's unset or not a valid positive number.
+func recordSegmentFromEnv() time.Duration {
+	const defaultRecordSegment = 10 * time.Second
+	raw := os.Getenv("RECORD_SEGMENT_SECONDS")
+	if raw == "" {
+		return defaultRecordSegment
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid RECORD_SEGMENT_SECONDS %q, using default of %s", raw, defaultRecordSegment)
+		return defaultRecordSegment
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func main() {
 	port := 8081
-	server := NewServer()
+	server := NewServer(pliIntervalFromEnv(), recordDirFromEnv(), recordSegmentFromEnv(), configFromEnv())
+	go server.runPLIScheduler()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
@@ -580,6 +2510,16 @@ func main() {
 	http.HandleFunc("/ws", server.handleWebSocket)
 	http.HandleFunc("/offer", server.handleOffer)
 	http.HandleFunc("/config", server.handleConfig)
+	http.HandleFunc("/whip", server.handleWHIP)
+	http.HandleFunc("/whep", server.handleWHEP)
+	http.HandleFunc("/whip/", server.handleWHIPResource)
+	http.HandleFunc("/whep/", server.handleWHIPResource)
+	http.HandleFunc("/recordings", server.handleRecordings)
+	http.HandleFunc("/recordings/", server.handleRecordingFile)
+	http.HandleFunc("/replay/", server.handleReplay)
+	http.HandleFunc("/ice/", server.handleICECandidate)
+	http.HandleFunc("/metrics", server.handleMetrics)
+	http.HandleFunc("/api/v1/receivers", server.handleAPIReceivers)
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
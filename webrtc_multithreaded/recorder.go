@@ -0,0 +1,506 @@
+package main
+
+/*
+Recording & Replay
+===================
+
+recorder attaches to every forwarded stream's RTP (via
+forwardSenderVideoTrack/forwardSenderAudioTrack) and writes it to disk using
+the same container formats as the pion save-to-disk examples: IVF for
+VP8/VP9, raw Annex B for H264, and Ogg for Opus. Video segments roll over to
+a fresh file on the next keyframe once the configured segment length has
+elapsed, so a segment is always independently decodable; audio just rolls
+over on a timer since Opus has no keyframe concept.
+
+/recordings lists finished-and-in-progress segments, /recordings/{id} serves
+the raw file, and /replay/{id} opens a brand new receiver PeerConnection and
+streams the file back by reading it with the matching reader and calling
+TrackLocalStaticSample.WriteSample at the file's declared frame rate -
+mirroring the pion play-from-disk examples.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// segmentWriter is the common shape of ivfwriter.IVFWriter, h264writer.H264Writer,
+// and oggwriter.OggWriter - just enough to drive one open segment file.
+type segmentWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// RecordingMeta describes one segment file, finished or still being written.
+type RecordingMeta struct {
+	ID        string    `json:"id"`
+	StreamID  string    `json:"streamId"`
+	Kind      string    `json:"kind"` // "video" or "audio"
+	MimeType  string    `json:"mimeType"`
+	StartedAt time.Time `json:"startedAt"`
+	Path      string    `json:"-"`
+}
+
+// recordingTrack is the currently-open segment for one streamID+kind.
+type recordingTrack struct {
+	id           string
+	segmentStart time.Time
+	writer       segmentWriter
+}
+
+func (t *recordingTrack) close() {
+	if t == nil || t.writer == nil {
+		return
+	}
+	if err := t.writer.Close(); err != nil {
+		log.Printf("Recorder: failed to close segment %s: %v", t.id, err)
+	}
+}
+
+// recorder segments every stream it's fed to disk under dir, rolling video
+// over on the first keyframe after segment has elapsed and audio over on a
+// plain timer.
+type recorder struct {
+	dir     string
+	segment time.Duration
+
+	mu     sync.Mutex
+	tracks map[string]*recordingTrack // keyed by streamID + ":" + kind
+	meta   map[string]*RecordingMeta  // keyed by RecordingMeta.ID
+}
+
+// newRecorder prepares dir (creating it if necessary) and returns a recorder
+// ready to accept WriteVideo/WriteAudio calls.
+func newRecorder(dir string, segment time.Duration) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &recorder{
+		dir:     dir,
+		segment: segment,
+		tracks:  make(map[string]*recordingTrack),
+		meta:    make(map[string]*RecordingMeta),
+	}, nil
+}
+
+// WriteVideo records one forwarded video RTP packet for streamID, opening a
+// new segment file at the stream's first keyframe and again on the first
+// keyframe once segment has elapsed. Packets arriving before the stream's
+// first keyframe are dropped - there's nothing useful to decode from
+// mid-GOP; after that, packets keep going into the open segment until the
+// keyframe that starts the next one.
+func (rec *recorder) WriteVideo(streamID, mimeType string, pkt *rtp.Packet, keyframe bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	key := streamID + ":video"
+	track := rec.tracks[key]
+	if track == nil || (keyframe && time.Since(track.segmentStart) >= rec.segment) {
+		if !keyframe {
+			return
+		}
+		next, err := rec.openVideoLocked(streamID, mimeType)
+		if err != nil {
+			log.Printf("Recorder: failed to open video segment for %q: %v", streamID, err)
+			return
+		}
+		track.close()
+		track = next
+		rec.tracks[key] = track
+	}
+
+	if err := track.writer.WriteRTP(pkt); err != nil {
+		log.Printf("Recorder: failed to write %q: %v", streamID, err)
+	}
+}
+
+// WriteAudio mirrors WriteVideo for a stream's Opus track. Opus has no
+// keyframe concept, so segments just roll over once segment has elapsed.
+func (rec *recorder) WriteAudio(streamID string, pkt *rtp.Packet, clockRate uint32) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	key := streamID + ":audio"
+	track := rec.tracks[key]
+	if track == nil || time.Since(track.segmentStart) >= rec.segment {
+		next, err := rec.openAudioLocked(streamID, clockRate)
+		if err != nil {
+			log.Printf("Recorder: failed to open audio segment for %q: %v", streamID, err)
+			return
+		}
+		track.close()
+		track = next
+		rec.tracks[key] = track
+	}
+
+	if err := track.writer.WriteRTP(pkt); err != nil {
+		log.Printf("Recorder: failed to write %q: %v", streamID, err)
+	}
+}
+
+// openVideoLocked starts a fresh video segment file for streamID. Callers
+// must hold rec.mu.
+func (rec *recorder) openVideoLocked(streamID, mimeType string) (*recordingTrack, error) {
+	id := fmt.Sprintf("%s-%d", streamID, time.Now().UnixNano())
+
+	var (
+		w   segmentWriter
+		err error
+		ext string
+	)
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		ext = "h264"
+		w, err = h264writer.New(filepath.Join(rec.dir, id+"."+ext))
+	case webrtc.MimeTypeVP8, webrtc.MimeTypeVP9:
+		ext = "ivf"
+		w, err = ivfwriter.New(filepath.Join(rec.dir, id+"."+ext))
+	default:
+		return nil, fmt.Errorf("unsupported video codec %q", mimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec.meta[id] = &RecordingMeta{
+		ID:        id,
+		StreamID:  streamID,
+		Kind:      "video",
+		MimeType:  mimeType,
+		StartedAt: time.Now(),
+		Path:      filepath.Join(rec.dir, id+"."+ext),
+	}
+	return &recordingTrack{id: id, segmentStart: time.Now(), writer: w}, nil
+}
+
+// openAudioLocked starts a fresh Opus segment file for streamID. Callers
+// must hold rec.mu.
+func (rec *recorder) openAudioLocked(streamID string, clockRate uint32) (*recordingTrack, error) {
+	id := fmt.Sprintf("%s-%d", streamID, time.Now().UnixNano())
+	path := filepath.Join(rec.dir, id+".ogg")
+
+	w, err := oggwriter.New(path, clockRate, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.meta[id] = &RecordingMeta{
+		ID:        id,
+		StreamID:  streamID,
+		Kind:      "audio",
+		MimeType:  webrtc.MimeTypeOpus,
+		StartedAt: time.Now(),
+		Path:      path,
+	}
+	return &recordingTrack{id: id, segmentStart: time.Now(), writer: w}, nil
+}
+
+// List returns every known segment, oldest first.
+func (rec *recorder) List() []RecordingMeta {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	out := make([]RecordingMeta, 0, len(rec.meta))
+	for _, m := range rec.meta {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// Lookup returns the metadata for one segment ID.
+func (rec *recorder) Lookup(id string) (RecordingMeta, bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	m, ok := rec.meta[id]
+	if !ok {
+		return RecordingMeta{}, false
+	}
+	return *m, true
+}
+
+// =============================================================================
+// HTTP Handlers
+// =============================================================================
+
+// handleRecordings lists every segment the recorder knows about.
+func (s *Server) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if s.recorder == nil {
+		json.NewEncoder(w).Encode([]RecordingMeta{})
+		return
+	}
+	json.NewEncoder(w).Encode(s.recorder.List())
+}
+
+// handleRecordingFile serves a single segment's raw file for download.
+func (s *Server) handleRecordingFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/recordings/")
+	if id == "" || s.recorder == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	meta, ok := s.recorder.Lookup(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeFile(w, r, meta.Path)
+}
+
+// handleReplay opens a new receiver PeerConnection and streams a saved
+// segment back over it, reading the file with whichever reader matches its
+// codec and pacing TrackLocalStaticSample.WriteSample calls to the file's
+// own frame rate.
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/replay/")
+	if id == "" || s.recorder == nil {
+		http.NotFound(w, r)
+		return
+	}
+	meta, ok := s.recorder.Lookup(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req OfferRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.newPeerConnection()
+	if err != nil {
+		http.Error(w, "PeerConnection failed", http.StatusInternalServerError)
+		return
+	}
+
+	capability, err := capabilityFor(meta.MimeType)
+	if err != nil {
+		pc.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(capability, meta.Kind, "replay-"+meta.ID)
+	if err != nil {
+		pc.Close()
+		http.Error(w, "Track create failed", http.StatusInternalServerError)
+		return
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		pc.Close()
+		http.Error(w, "Failed to add track", http.StatusInternalServerError)
+		return
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: req.SDP}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		pc.Close()
+		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	localDesc := pc.LocalDescription()
+	if localDesc == nil {
+		pc.Close()
+		http.Error(w, "Local description not set", http.StatusInternalServerError)
+		return
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		s.setPeerConnectionState("replay:"+meta.ID, "replay", state)
+		if state == webrtc.PeerConnectionStateConnected {
+			go playRecording(meta, track, pc)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"sdp":  localDesc.SDP,
+		"type": "answer",
+	})
+}
+
+// capabilityFor returns the RTPCodecCapability a replayed segment's
+// TrackLocalStaticSample needs, matching what openVideoLocked/openAudioLocked
+// recorded it with.
+func capabilityFor(mimeType string) (webrtc.RTPCodecCapability, error) {
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, nil
+	case webrtc.MimeTypeVP8:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, nil
+	case webrtc.MimeTypeVP9:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}, nil
+	case webrtc.MimeTypeOpus:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, nil
+	default:
+		return webrtc.RTPCodecCapability{}, fmt.Errorf("unsupported replay codec %q", mimeType)
+	}
+}
+
+// h264FrameDuration paces replayed H264 Annex B streams, which carry no
+// per-frame timing of their own, at a conventional 30fps.
+const h264FrameDuration = 33 * time.Millisecond
+
+// oggPageDuration mirrors the 20ms Opus frame size oggwriter assumes when it
+// wrote the file in openAudioLocked.
+const oggPageDuration = 20 * time.Millisecond
+
+// playRecording reads meta.Path back with the reader matching its codec and
+// writes it into track at the file's declared (or, for H264/Opus, assumed)
+// frame rate - the ivf-playback pattern from the pion examples, generalized
+// across the three container formats this recorder writes.
+func playRecording(meta RecordingMeta, track *webrtc.TrackLocalStaticSample, pc *webrtc.PeerConnection) {
+	defer pc.Close()
+
+	file, err := os.Open(meta.Path)
+	if err != nil {
+		log.Printf("Replay %s: failed to open %s: %v", meta.ID, meta.Path, err)
+		return
+	}
+	defer file.Close()
+
+	switch meta.MimeType {
+	case webrtc.MimeTypeVP8, webrtc.MimeTypeVP9:
+		playIVF(file, track)
+	case webrtc.MimeTypeH264:
+		playH264(file, track)
+	case webrtc.MimeTypeOpus:
+		playOgg(file, track)
+	}
+
+	log.Printf("Replay %s: finished", meta.ID)
+}
+
+func playIVF(file *os.File, track *webrtc.TrackLocalStaticSample) {
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		log.Printf("Replay: ivf reader failed: %v", err)
+		return
+	}
+
+	frameDuration := time.Duration(float64(header.TimebaseNumerator)/float64(header.TimebaseDenominator)*1000) * time.Millisecond
+	if frameDuration <= 0 {
+		frameDuration = h264FrameDuration
+	}
+
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+	for range ticker.C {
+		frame, _, err := reader.ParseNextFrame()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Replay: ivf frame failed: %v", err)
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: frameDuration}); err != nil {
+			log.Printf("Replay: write sample failed: %v", err)
+			return
+		}
+	}
+}
+
+func playH264(file *os.File, track *webrtc.TrackLocalStaticSample) {
+	reader, err := h264reader.NewReader(file)
+	if err != nil {
+		log.Printf("Replay: h264 reader failed: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(h264FrameDuration)
+	defer ticker.Stop()
+	for range ticker.C {
+		nal, err := reader.NextNAL()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Replay: h264 NAL failed: %v", err)
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: nal.Data, Duration: h264FrameDuration}); err != nil {
+			log.Printf("Replay: write sample failed: %v", err)
+			return
+		}
+	}
+}
+
+func playOgg(file *os.File, track *webrtc.TrackLocalStaticSample) {
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		log.Printf("Replay: ogg reader failed: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(oggPageDuration)
+	defer ticker.Stop()
+	for range ticker.C {
+		page, _, err := reader.ParseNextPage()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Replay: ogg page failed: %v", err)
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: page, Duration: oggPageDuration}); err != nil {
+			log.Printf("Replay: write sample failed: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package signaling implements a protoo-like request/response/notification
+// protocol for a WebRTC SFU room: any Peer may publish or subscribe to any
+// other Peer's tracks by ID, instead of the server assuming one fixed sender
+// and N subscribers. It deliberately knows nothing about WebRTC itself (no
+// pion import) - the caller owns PeerConnections and SDP, this package only
+// owns the wire protocol and the room/peer/track bookkeeping around it.
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Message is the protoo wire envelope. Exactly one of Request, Response, or
+// Notification is true, matching the three message kinds protoo defines:
+// requests expect a correlated response carrying the same ID, notifications
+// don't.
+type Message struct {
+	Request      bool            `json:"request,omitempty"`
+	Response     bool            `json:"response,omitempty"`
+	Notification bool            `json:"notification,omitempty"`
+	ID           uint32          `json:"id,omitempty"`
+	Method       string          `json:"method,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	OK           bool            `json:"ok,omitempty"`
+	ErrorReason  string          `json:"errorReason,omitempty"`
+}
+
+// NewRequest builds a request Message. data may be nil.
+func NewRequest(id uint32, method string, data interface{}) Message {
+	return Message{Request: true, ID: id, Method: method, Data: marshal(data)}
+}
+
+// NewResponse builds a successful reply correlated to request id.
+func NewResponse(id uint32, data interface{}) Message {
+	return Message{Response: true, ID: id, OK: true, Data: marshal(data)}
+}
+
+// NewErrorResponse builds a failed reply correlated to request id.
+func NewErrorResponse(id uint32, reason string) Message {
+	return Message{Response: true, ID: id, OK: false, ErrorReason: reason}
+}
+
+// NewNotification builds a fire-and-forget Message, used for room events
+// peers didn't explicitly ask for (newProducer, peerClosed, ...).
+func NewNotification(method string, data interface{}) Message {
+	return Message{Notification: true, Method: method, Data: marshal(data)}
+}
+
+func marshal(data interface{}) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Peer is one signaling-protocol participant in a Room: a publisher, a
+// subscriber, or (as with this server's single Python sender) both. Send
+// delivers a Message over whatever transport the caller is using
+// (WebSocket, DataChannel, ...) and must be safe to call concurrently.
+type Peer struct {
+	ID   string
+	Send func(Message) error
+}
+
+// Producer is one track a Peer has published, identified by a caller-chosen
+// TrackID (this server uses its stream name) that Subscribe calls reference.
+type Producer struct {
+	PeerID  string
+	TrackID string
+	Kind    string // "video" or "audio"
+}
+
+// Room holds every Peer currently joined and every track they've published,
+// and turns publish/unpublish/leave into protoo-style notifications to
+// the room's other peers (a bare Join notifies no one).
+type Room struct {
+	mu        sync.RWMutex
+	peers     map[string]*Peer
+	producers map[string]*Producer // keyed by TrackID
+}
+
+// NewRoom returns an empty Room ready to accept peers.
+func NewRoom() *Room {
+	return &Room{
+		peers:     make(map[string]*Peer),
+		producers: make(map[string]*Producer),
+	}
+}
+
+// Join adds peer to the room and returns a snapshot of every track already
+// published, so the new peer knows what it can immediately subscribe to. It
+// does not itself notify anyone - unlike publish/unpublish, a bare join is
+// usually silent until the peer actually produces or consumes something.
+func (room *Room) Join(peer *Peer) []Producer {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.peers[peer.ID] = peer
+
+	existing := make([]Producer, 0, len(room.producers))
+	for _, p := range room.producers {
+		existing = append(existing, *p)
+	}
+	return existing
+}
+
+// Leave removes peer from the room, unpublishes every track it owned, and
+// notifies the remaining peers of both.
+func (room *Room) Leave(peerID string) {
+	room.mu.Lock()
+	delete(room.peers, peerID)
+	var closed []Producer
+	for trackID, p := range room.producers {
+		if p.PeerID == peerID {
+			closed = append(closed, *p)
+			delete(room.producers, trackID)
+		}
+	}
+	remaining := room.otherPeersLocked(peerID)
+	room.mu.Unlock()
+
+	for _, p := range closed {
+		notifyAll(remaining, NewNotification("producerClosed", p))
+	}
+	notifyAll(remaining, NewNotification("peerClosed", map[string]string{"peerId": peerID}))
+}
+
+// Publish registers trackID as peerID's, erroring if another peer already
+// owns that ID. On success it notifies every other peer with "newProducer"
+// so they can choose to Subscribe.
+func (room *Room) Publish(peerID, trackID, kind string) (Producer, error) {
+	room.mu.Lock()
+	if existing, ok := room.producers[trackID]; ok && existing.PeerID != peerID {
+		room.mu.Unlock()
+		return Producer{}, fmt.Errorf("track %q already published by peer %q", trackID, existing.PeerID)
+	}
+	producer := Producer{PeerID: peerID, TrackID: trackID, Kind: kind}
+	room.producers[trackID] = &producer
+	others := room.otherPeersLocked(peerID)
+	room.mu.Unlock()
+
+	notifyAll(others, NewNotification("newProducer", producer))
+	return producer, nil
+}
+
+// Unpublish removes peerID's trackID, notifying every other peer so any
+// subscriber can tear down its end.
+func (room *Room) Unpublish(peerID, trackID string) error {
+	room.mu.Lock()
+	producer, ok := room.producers[trackID]
+	if !ok || producer.PeerID != peerID {
+		room.mu.Unlock()
+		return fmt.Errorf("peer %q does not own track %q", peerID, trackID)
+	}
+	delete(room.producers, trackID)
+	others := room.otherPeersLocked(peerID)
+	room.mu.Unlock()
+
+	notifyAll(others, NewNotification("producerClosed", *producer))
+	return nil
+}
+
+// Subscribe looks up trackID's producer so the caller can wire up the
+// corresponding media. It does not track subscriptions itself - that's
+// inherently transport state (an RTPSender on some other peer's
+// PeerConnection), which belongs to the caller, not this package.
+func (room *Room) Subscribe(trackID string) (Producer, error) {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	producer, ok := room.producers[trackID]
+	if !ok {
+		return Producer{}, fmt.Errorf("no producer for track %q", trackID)
+	}
+	return *producer, nil
+}
+
+// otherPeersLocked returns every peer but except, in room.mu. Callers must
+// already hold room.mu.
+func (room *Room) otherPeersLocked(except string) []*Peer {
+	others := make([]*Peer, 0, len(room.peers))
+	for id, p := range room.peers {
+		if id != except {
+			others = append(others, p)
+		}
+	}
+	return others
+}
+
+func notifyAll(peers []*Peer, msg Message) {
+	for _, p := range peers {
+		p.Send(msg)
+	}
+}